@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// UpstreamAccount 上游账号配置
+type UpstreamAccount struct {
+	Name   string `yaml:"name" json:"name"`
+	Token  string `yaml:"token" json:"token"`
+	Weight int    `yaml:"weight" json:"weight"`
+}
+
+// accounts 返回生效的账号列表；未配置 upstream_accounts 时使用 upstream_token
+func (c *Config) accounts() []UpstreamAccount {
+	if len(c.UpstreamAccounts) > 0 {
+		return c.UpstreamAccounts
+	}
+	if c.UpstreamToken != "" {
+		return []UpstreamAccount{{Name: "default", Token: c.UpstreamToken, Weight: 1}}
+	}
+	return nil
+}
+
+// accountState 账号运行状态（按名称跟踪，跨配置热加载保留）
+type accountState struct {
+	current       int // 平滑加权轮询的当前权重
+	cooldownUntil time.Time
+	lastError     string
+	requests      int64
+	failures      int64
+}
+
+// AccountStatus 账号状态（用于管理接口）
+type AccountStatus struct {
+	Name          string     `json:"name"`
+	Weight        int        `json:"weight"`
+	Available     bool       `json:"available"`
+	CooldownUntil *time.Time `json:"cooldown_until,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	Requests      int64      `json:"requests"`
+	Failures      int64      `json:"failures"`
+	Token         TokenInfo  `json:"token"`
+}
+
+// AccountPool 上游账号池：平滑加权轮询，被拒绝的账号进入冷却
+type AccountPool struct {
+	mu     sync.Mutex
+	states map[string]*accountState
+}
+
+var accountPool = &AccountPool{states: map[string]*accountState{}}
+
+func (p *AccountPool) state(name string) *accountState {
+	st, ok := p.states[name]
+	if !ok {
+		st = &accountState{}
+		p.states[name] = st
+	}
+	return st
+}
+
+// Pick 按权重选择一个未尝试过的可用账号；全部冷却时选择最早恢复的账号，token已过期的账号排在最后
+func (p *AccountPool) Pick(cfg *Config, exclude map[string]bool) *UpstreamAccount {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	accounts := cfg.accounts()
+	var best, soonest, expired *UpstreamAccount
+	var bestState *accountState
+	total := 0
+	for i := range accounts {
+		acc := &accounts[i]
+		if exclude[acc.Name] {
+			continue
+		}
+		st := p.state(acc.Name)
+		if exp := tokenExpiry(acc.Token); !exp.IsZero() && now.After(exp) {
+			// token已过期，除非没有其他账号可用，否则跳过
+			if expired == nil {
+				expired = acc
+			}
+			continue
+		}
+		if now.Before(st.cooldownUntil) {
+			if soonest == nil || st.cooldownUntil.Before(p.state(soonest.Name).cooldownUntil) {
+				soonest = acc
+			}
+			continue
+		}
+		st.current += acc.Weight
+		total += acc.Weight
+		if best == nil || st.current > bestState.current {
+			best, bestState = acc, st
+		}
+	}
+	if best == nil {
+		if soonest == nil {
+			soonest = expired
+		}
+		if soonest != nil {
+			p.state(soonest.Name).requests++
+		}
+		return soonest
+	}
+	bestState.current -= total
+	bestState.requests++
+	return best
+}
+
+// Cooldown 账号被上游拒绝后进入冷却
+func (p *AccountPool) Cooldown(cfg *Config, name, reason string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st := p.state(name)
+	st.cooldownUntil = time.Now().Add(cfg.AccountCooldown.D())
+	st.lastError = reason
+	st.failures++
+	debugLog("上游账号 %s 进入冷却 %v: %s", name, cfg.AccountCooldown, reason)
+}
+
+// Status 返回全部账号状态
+func (p *AccountPool) Status(cfg *Config) []AccountStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	var list []AccountStatus
+	for _, acc := range cfg.accounts() {
+		st := p.state(acc.Name)
+		s := AccountStatus{
+			Name:      acc.Name,
+			Weight:    acc.Weight,
+			Available: !now.Before(st.cooldownUntil),
+			LastError: st.lastError,
+			Requests:  st.requests,
+			Failures:  st.failures,
+			Token:     inspectToken("account:"+acc.Name, acc.Token),
+		}
+		if now.Before(st.cooldownUntil) {
+			until := st.cooldownUntil
+			s.CooldownUntil = &until
+		}
+		if s.Token.Expired {
+			s.Available = false
+		}
+		list = append(list, s)
+	}
+	return list
+}
+
+// upstreamAuth 一次上游调用使用的凭证
+type upstreamAuth struct {
+	Token   string
+	Account string // 账号名称，匿名token为空
+}
+
+func (a *upstreamAuth) String() string {
+	if a.Account == "" {
+		return "anonymous"
+	}
+	return "account:" + a.Account
+}
+
+// authChain 单个请求的凭证序列：优先匿名token，随后依次尝试各个上游账号
+type authChain struct {
+	cfg       *Config
+	anonTried bool
+	tried     map[string]bool
+	pinned    *upstreamAuth // 会话沿用的凭证，最先尝试
+	used      *upstreamAuth // 最近一次取出的凭证
+}
+
+func newAuthChain(cfg *Config) *authChain {
+	return &authChain{cfg: cfg, tried: map[string]bool{}}
+}
+
+// pin 优先使用指定凭证（会话的上一轮所用凭证），被拒绝后再走正常的凭证序列
+func (c *authChain) pin(a *upstreamAuth) {
+	c.pinned = a
+}
+
+// next 返回下一个待尝试的凭证，没有更多凭证时返回 false
+func (c *authChain) next(ctx context.Context) (*upstreamAuth, bool) {
+	a, ok := c.pick(ctx)
+	if ok {
+		c.used = a
+	}
+	return a, ok
+}
+
+func (c *authChain) pick(ctx context.Context) (*upstreamAuth, bool) {
+	if a := c.pinned; a != nil {
+		c.pinned = nil
+		if a.Account != "" {
+			c.tried[a.Account] = true
+		}
+		debugLog("沿用会话凭证: %s", a)
+		return a, true
+	}
+	if c.cfg.AnonTokenEnabled && !c.anonTried {
+		c.anonTried = true
+		if t, err := anonPool.Acquire(ctx, c.cfg); err == nil {
+			debugLog("匿名token获取成功: %s", maskKey(t))
+			return &upstreamAuth{Token: t}, true
+		} else {
+			debugLog("匿名token获取失败，回退上游账号: %v", err)
+		}
+	}
+	acc := accountPool.Pick(c.cfg, c.tried)
+	if acc == nil {
+		return nil, false
+	}
+	c.tried[acc.Name] = true
+	return &upstreamAuth{Token: acc.Token, Account: acc.Name}, true
+}
+
+// restart 为新的上游对话重新开始凭证序列，优先沿用上一次取出的凭证
+func (c *authChain) restart() {
+	c.anonTried, c.tried, c.pinned = false, map[string]bool{}, c.used
+}
+
+// allowFreshAnonymous 允许再取一个新的匿名token（用于流中断后的重放）
+func (c *authChain) allowFreshAnonymous() {
+	c.anonTried = false
+}
+
+// fail 凭证被上游拒绝：淘汰匿名token或令账号进入冷却
+func (c *authChain) fail(a *upstreamAuth, reason string) {
+	if a.Account == "" {
+		anonPool.Evict(a.Token, reason)
+		return
+	}
+	accountPool.Cooldown(c.cfg, a.Account, reason)
+}
+
+// isAuthRejection 判断上游状态码是否表示凭证不可用
+func isAuthRejection(status int) bool {
+	return status == http.StatusUnauthorized || status == http.StatusForbidden || status == http.StatusTooManyRequests
+}
+
+var errNoUpstreamAuth = errors.New("no upstream credential available")
+
+// upstreamAuthError 所有凭证都被上游拒绝
+type upstreamAuthError struct {
+	Status string // 最后一次被拒绝的状态
+}
+
+func (e *upstreamAuthError) Error() string {
+	return "upstream rejected all credentials, last status: " + e.Status
+}
+
+// callUpstreamWithFailover 依次使用凭证调用上游（含图片上传），遇到401/403/429时换下一个凭证重试；
+// 返回的响应状态码总是200，其他状态（含重试用尽的5xx）转换为 *upstreamStatusError
+func callUpstreamWithFailover(ctx context.Context, cfg *Config, upstreamReq UpstreamRequest, chatID string, chain *authChain) (*http.Response, *upstreamAuth, error) {
+	var lastErr error = errNoUpstreamAuth
+	for {
+		auth, ok := chain.next(ctx)
+		if !ok {
+			return nil, nil, lastErr
+		}
+		req := upstreamReq
+		if len(upstreamReq.images) > 0 {
+			// 上游文件归属于账号：每个凭证上传一次，重试时沿用
+			msgs, files, err := uploadImages(ctx, cfg, upstreamReq.Messages, upstreamReq.images, auth.Token)
+			var se *uploadStatusError
+			if errors.As(err, &se) && isAuthRejection(se.StatusCode) {
+				debugLog("上游拒绝凭证 %s 上传图片: %s，尝试下一个", auth, se.Status)
+				chain.fail(auth, se.Status)
+				lastErr = &upstreamAuthError{se.Status}
+				continue
+			}
+			if err != nil {
+				debugLog("图片上传失败: %v", err)
+				return nil, auth, err
+			}
+			req.Messages, req.Files = msgs, files
+		}
+		resp, err := callUpstreamWithRetry(ctx, cfg, req, chatID, auth.Token)
+		if err != nil {
+			return nil, auth, err
+		}
+		if resp.StatusCode == http.StatusOK {
+			return resp, auth, nil
+		}
+		if !isAuthRejection(resp.StatusCode) {
+			return nil, auth, newUpstreamStatusError(cfg, resp)
+		}
+		debugLog("上游拒绝凭证 %s: %s，尝试下一个", auth, resp.Status)
+		chain.fail(auth, resp.Status)
+		resp.Body.Close()
+		lastErr = &upstreamAuthError{resp.Status}
+	}
+}
+
+// watchAccountExpiry 定期检查上游账号token的过期时间，临近过期时输出告警
+func watchAccountExpiry() {
+	warned := map[string]bool{}
+	for {
+		cfg := getConfig()
+		for _, acc := range cfg.accounts() {
+			exp := tokenExpiry(acc.Token)
+			key := acc.Name + "@" + exp.String()
+			if expiresWithin(exp, cfg.TokenRefreshMargin.D()) && !warned[key] {
+				warned[key] = true
+				if time.Now().After(exp) {
+					log.Printf("上游账号 %s 的token已于 %s 过期，请及时更换", acc.Name, exp.Format(time.RFC3339))
+				} else {
+					log.Printf("上游账号 %s 的token将于 %s 过期，请及时更换", acc.Name, exp.Format(time.RFC3339))
+				}
+			}
+		}
+		time.Sleep(time.Minute)
+	}
+}
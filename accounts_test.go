@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func pickN(p *AccountPool, cfg *Config, n int) string {
+	got := make([]string, n)
+	for i := range got {
+		if acc := p.Pick(cfg, nil); acc != nil {
+			got[i] = acc.Name
+		}
+	}
+	return strings.Join(got, ",")
+}
+
+// 平滑加权轮询：按权重分配且不会连续集中到同一个账号
+func TestAccountPoolWeightedRotation(t *testing.T) {
+	tests := []struct {
+		accounts []UpstreamAccount
+		want     string
+	}{
+		{[]UpstreamAccount{{Name: "a", Weight: 1}}, "a,a,a"},
+		{[]UpstreamAccount{{Name: "a", Weight: 1}, {Name: "b", Weight: 1}}, "a,b,a,b"},
+		{[]UpstreamAccount{{Name: "a", Weight: 5}, {Name: "b", Weight: 1}, {Name: "c", Weight: 1}}, "a,a,b,a,c,a,a,a,a,b,a,c,a,a"},
+		{[]UpstreamAccount{{Name: "a", Weight: 2}, {Name: "b", Weight: 1}}, "a,b,a,a,b,a"},
+	}
+	for _, tt := range tests {
+		p := &AccountPool{states: map[string]*accountState{}}
+		cfg := &Config{UpstreamAccounts: tt.accounts}
+		if got := pickN(p, cfg, len(strings.Split(tt.want, ","))); got != tt.want {
+			t.Errorf("%+v: got %s, want %s", tt.accounts, got, tt.want)
+		}
+	}
+}
+
+func TestAccountPoolCooldown(t *testing.T) {
+	p := &AccountPool{states: map[string]*accountState{}}
+	cfg := &Config{
+		UpstreamAccounts: []UpstreamAccount{{Name: "a", Weight: 3}, {Name: "b", Weight: 1}},
+		AccountCooldown:  Duration(time.Minute),
+	}
+	// 冷却中的账号不参与轮询
+	p.Cooldown(cfg, "a", "401")
+	if got := pickN(p, cfg, 3); got != "b,b,b" {
+		t.Errorf("a 冷却中: got %s", got)
+	}
+	// 本次对话已尝试过的账号被排除
+	if acc := p.Pick(cfg, map[string]bool{"b": true}); acc == nil || acc.Name != "a" {
+		t.Errorf("排除 b 后 = %+v, want 全部冷却时最早恢复的 a", acc)
+	}
+	// 全部冷却时选择最早恢复的账号
+	p.Cooldown(cfg, "b", "429")
+	p.state("a").cooldownUntil = time.Now().Add(time.Second)
+	if acc := p.Pick(cfg, nil); acc == nil || acc.Name != "a" {
+		t.Errorf("全部冷却时 = %+v, want a", acc)
+	}
+	if acc := p.Pick(cfg, map[string]bool{"a": true, "b": true}); acc != nil {
+		t.Errorf("全部排除时 = %+v", acc)
+	}
+
+	// 冷却结束后恢复轮询
+	p.state("a").cooldownUntil = time.Time{}
+	p.state("b").cooldownUntil = time.Time{}
+	if got := pickN(p, cfg, 4); strings.Count(got, "a") != 3 {
+		t.Errorf("冷却结束后 got %s", got)
+	}
+	s := p.Status(cfg)
+	if len(s) != 2 || !s[0].Available || s[0].Failures != 1 || s[0].LastError != "401" || s[1].Failures != 1 {
+		t.Errorf("status = %+v", s)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// withAdmin 管理接口鉴权：使用配置中的 admin_key，未配置时管理接口不可用
+func withAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := getConfig()
+		if cfg.AdminKey == "" {
+			http.NotFound(w, r)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminKey)) != 1 {
+			debugLog("管理接口鉴权失败 (%s)", maskKey(token))
+			http.Error(w, "Invalid admin key", http.StatusUnauthorized)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), ctxKeyConfig, cfg)))
+	}
+}
+
+// writeJSON 输出JSON响应
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// handleHealth 健康检查（无需鉴权）：熔断器打开时返回503
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	cfg := getConfig()
+	breaker := upstreamBreaker.Status(cfg)
+	status := "ok"
+	if breaker.State != BreakerClosed {
+		status = "degraded"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if breaker.State == BreakerOpen {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":          status,
+		"circuit_breaker": breaker,
+		"requests":        metrics.Snapshot(),
+	})
+}
+
+// handleAdminPool 匿名token池统计
+func handleAdminPool(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, anonPool.Stats(configFromContext(r.Context())))
+}
+
+// handleAdminAccounts 上游账号状态
+func handleAdminAccounts(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, accountPool.Status(configFromContext(r.Context())))
+}
+
+// handleAdminTokens 上游token身份与剩余有效期（账号token与匿名池token，均已脱敏）
+func handleAdminTokens(w http.ResponseWriter, r *http.Request) {
+	cfg := configFromContext(r.Context())
+	var list []TokenInfo
+	for _, acc := range cfg.accounts() {
+		list = append(list, inspectToken("account:"+acc.Name, acc.Token))
+	}
+	list = append(list, anonPool.Tokens()...)
+	writeJSON(w, list)
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"z2api/thinking"
+)
+
+// Anthropic Messages API（/v1/messages）：请求转换为上游对话，上游的思考/回答阶段转换为 thinking/text 内容块
+
+// AnthropicRequest Messages API 请求
+type AnthropicRequest struct {
+	Model         string             `json:"model"`
+	Messages      []AnthropicMessage `json:"messages"`
+	System        json.RawMessage    `json:"system,omitempty"` // 字符串或 text 块数组
+	MaxTokens     int                `json:"max_tokens"`
+	StopSequences []string           `json:"stop_sequences,omitempty"`
+	Stream        bool               `json:"stream,omitempty"`
+	Thinking      *AnthropicThinking `json:"thinking,omitempty"`
+	Tools         json.RawMessage    `json:"tools,omitempty"`
+}
+
+// AnthropicThinking 扩展思考设置
+type AnthropicThinking struct {
+	Type         string `json:"type"` // enabled / disabled
+	BudgetTokens int    `json:"budget_tokens,omitempty"`
+}
+
+// AnthropicMessage 对话消息，content 为字符串或内容块数组
+type AnthropicMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+// AnthropicBlock 请求中的内容块
+type AnthropicBlock struct {
+	Type   string           `json:"type"`
+	Text   string           `json:"text,omitempty"`
+	Source *AnthropicSource `json:"source,omitempty"`
+}
+
+// AnthropicSource 图片来源
+type AnthropicSource struct {
+	Type      string `json:"type"` // base64 / url
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+// AnthropicResponse 非流式响应，也用于 message_start 事件
+type AnthropicResponse struct {
+	ID           string         `json:"id"`
+	Type         string         `json:"type"`
+	Role         string         `json:"role"`
+	Model        string         `json:"model"`
+	Content      []any          `json:"content"`
+	StopReason   *string        `json:"stop_reason"`
+	StopSequence *string        `json:"stop_sequence"`
+	Usage        AnthropicUsage `json:"usage"`
+}
+
+// AnthropicUsage 用量（上游不返回，固定为0）
+type AnthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type anthropicThinkingBlock struct {
+	Type      string `json:"type"`
+	Thinking  string `json:"thinking"`
+	Signature string `json:"signature"`
+}
+
+type anthropicTextBlock struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// toMessages 把 system 与消息转换为上游消息；不支持的内容块返回错误
+func (r *AnthropicRequest) toMessages() ([]Message, error) {
+	var msgs []Message
+	if len(r.System) > 0 && string(r.System) != "null" {
+		system, _, err := anthropicContent(r.System)
+		if err != nil {
+			return nil, fmt.Errorf("system: %v", err)
+		}
+		if system != "" {
+			msgs = append(msgs, Message{Role: "system", Content: system})
+		}
+	}
+	for i, m := range r.Messages {
+		if m.Role != "user" && m.Role != "assistant" {
+			return nil, fmt.Errorf("messages.%d.role: unexpected role %q", i, m.Role)
+		}
+		text, parts, err := anthropicContent(m.Content)
+		if err != nil {
+			return nil, fmt.Errorf("messages.%d.content: %v", i, err)
+		}
+		msgs = append(msgs, Message{Role: m.Role, Content: text, Parts: parts})
+	}
+	return msgs, nil
+}
+
+// anthropicContent 解析字符串或内容块数组：text 块拼接，图片转换为 image_url 片段，历史中的 thinking 块丢弃
+func anthropicContent(raw json.RawMessage) (string, []ContentPart, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || raw[0] != '[' {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return "", nil, fmt.Errorf("expected a string or an array of content blocks")
+		}
+		return s, nil, nil
+	}
+	var blocks []AnthropicBlock
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return "", nil, err
+	}
+	var texts []string
+	var parts []ContentPart
+	for _, b := range blocks {
+		switch b.Type {
+		case "text":
+			texts = append(texts, b.Text)
+		case "image":
+			if b.Source == nil {
+				return "", nil, fmt.Errorf("image block without source")
+			}
+			url := b.Source.URL
+			if b.Source.Type == "base64" {
+				url = "data:" + b.Source.MediaType + ";base64," + b.Source.Data
+			}
+			if url == "" {
+				return "", nil, fmt.Errorf("unsupported image source type %q", b.Source.Type)
+			}
+			parts = append(parts, ContentPart{Type: "image_url", ImageURL: &ImageURL{URL: url}})
+		case "thinking", "redacted_thinking":
+		default:
+			return "", nil, fmt.Errorf("unsupported content block type %q", b.Type)
+		}
+	}
+	return strings.Join(texts, "\n"), parts, nil
+}
+
+// writeAnthropicError 以 Anthropic 错误格式返回
+func writeAnthropicError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(anthropicError(status, message))
+}
+
+// anthropicErrors 供鉴权与限流中间件使用的 Anthropic 格式错误
+func anthropicErrors(w http.ResponseWriter, status int, _, _ string, message string) {
+	writeAnthropicError(w, status, message)
+}
+
+func anthropicError(status int, message string) map[string]any {
+	errType := "api_error"
+	switch status {
+	case http.StatusBadRequest:
+		errType = "invalid_request_error"
+	case http.StatusUnauthorized:
+		errType = "authentication_error"
+	case http.StatusForbidden:
+		errType = "permission_error"
+	case http.StatusRequestEntityTooLarge:
+		errType = "request_too_large"
+	case http.StatusTooManyRequests:
+		errType = "rate_limit_error"
+	case http.StatusServiceUnavailable:
+		errType = "overloaded_error"
+	}
+	return map[string]any{"type": "error", "error": map[string]string{"type": errType, "message": message}}
+}
+
+func newAnthropicMessageID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "msg_" + hex.EncodeToString(b)
+}
+
+func handleAnthropicMessages(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	debugLog("收到Anthropic messages请求")
+	metrics.Requests.Add(1)
+
+	cfg := configFromContext(r.Context())
+	apiKey := apiKeyFromContext(r.Context())
+
+	var req AnthropicRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		debugLog("JSON解析失败: %v", err)
+		writeAnthropicError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+	debugLog("请求解析成功 - 模型: %s, 流式: %v, 消息数: %d", req.Model, req.Stream, len(req.Messages))
+
+	switch {
+	case len(req.Messages) == 0:
+		writeAnthropicError(w, http.StatusBadRequest, "messages: at least one message is required")
+		return
+	case req.MaxTokens <= 0:
+		writeAnthropicError(w, http.StatusBadRequest, "max_tokens: must be greater than 0")
+		return
+	case len(req.Tools) > 0 && string(req.Tools) != "null" && string(req.Tools) != "[]":
+		writeAnthropicError(w, http.StatusBadRequest, "tools: tool use is not supported on /v1/messages, use /v1/chat/completions")
+		return
+	}
+	if !apiKey.allowsModel(req.Model) {
+		debugLog("密钥 %s 无权访问模型: %s", apiKey.ID, req.Model)
+		writeAnthropicError(w, http.StatusForbidden, "Model not allowed for this API key")
+		return
+	}
+
+	messages, err := req.toMessages()
+	if err != nil {
+		writeAnthropicError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	isThinking, isSearch := modelFeatures(req.Model)
+	thinkingBudget := 0
+	if t := req.Thinking; t != nil {
+		switch t.Type {
+		case "enabled":
+			isThinking, thinkingBudget = true, t.BudgetTokens
+		case "disabled":
+			isThinking = false
+		default:
+			writeAnthropicError(w, http.StatusBadRequest, fmt.Sprintf("thinking.type: invalid value %q", t.Type))
+			return
+		}
+	}
+	images, err := prepareImages(r.Context(), cfg, messages)
+	if err != nil {
+		writeAnthropicError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	upstreamReq := newUpstreamRequest(cfg, messages, images, isThinking, isSearch)
+	upstreamReq.Params["max_tokens"] = req.MaxTokens
+	if len(req.StopSequences) > 0 {
+		upstreamReq.Params["stop"] = req.StopSequences
+	}
+	debugLog("思考: %v, 思考预算: %d, max_tokens: %d, 停止序列: %d个", isThinking, thinkingBudget, req.MaxTokens, len(req.StopSequences))
+
+	ctx, cancel := withUpstreamDeadlines(r.Context(), resolveDeadlines(cfg, req.Model, r.Header))
+	defer cancel()
+
+	turn := &turnLimits{
+		thinkingBudget: newTokenBudget(thinkingBudget),
+		contentBudget:  newTokenBudget(req.MaxTokens),
+		stop:           newStopMatcher(req.StopSequences),
+	}
+	msg := AnthropicResponse{
+		ID:      newAnthropicMessageID(),
+		Type:    "message",
+		Role:    "assistant",
+		Model:   req.Model,
+		Content: []any{},
+	}
+
+	if req.Stream {
+		handleAnthropicStream(ctx, w, cfg, upstreamReq, turn, msg)
+		return
+	}
+
+	var reasoning, content strings.Builder
+	err = runUpstream(ctx, cfg, upstreamReq, newAuthChain(cfg), thinking.ModeStrip, func(isReasoning bool, s string) bool {
+		kind, text, more := turn.accept(isReasoning, s)
+		if kind == "thinking" {
+			reasoning.WriteString(text)
+		} else {
+			content.WriteString(text)
+		}
+		return more
+	})
+	if err != nil {
+		if f, ok := describeUpstreamFailure(ctx, w, cfg, err); ok {
+			writeAnthropicError(w, f.Status, f.Message)
+		}
+		return
+	}
+	content.WriteString(turn.finish())
+
+	if reasoning.Len() > 0 {
+		msg.Content = append(msg.Content, anthropicThinkingBlock{Type: "thinking", Thinking: reasoning.String()})
+	}
+	msg.Content = append(msg.Content, anthropicTextBlock{Type: "text", Text: content.String()})
+	msg.StopReason, msg.StopSequence = anthropicStopReason(turn)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msg)
+	metrics.Completed.Add(1)
+	debugLog("Anthropic非流式响应发送完成")
+}
+
+// anthropicStopReason 返回 stop_reason 与 stop_sequence
+func anthropicStopReason(t *turnLimits) (*string, *string) {
+	reason := "end_turn"
+	switch {
+	case t.contentBudget.exhausted():
+		reason = "max_tokens"
+	case t.stop != nil && t.stop.hit != "":
+		reason = "stop_sequence"
+		return &reason, &t.stop.hit
+	}
+	return &reason, nil
+}
+
+// anthropicStream 按 Anthropic 事件序列输出；第一个事件在收到首个增量时才发送，
+// 因此上游在输出前失败时仍可返回正常的HTTP错误
+type anthropicStream struct {
+	w       http.ResponseWriter
+	cfg     *Config
+	out     *sseWriter
+	msg     AnthropicResponse
+	index   int
+	current string // 当前打开的内容块类型，空表示没有
+}
+
+func handleAnthropicStream(ctx context.Context, w http.ResponseWriter, cfg *Config, upstreamReq UpstreamRequest, turn *turnLimits, msg AnthropicResponse) {
+	if _, ok := w.(http.Flusher); !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	st := &anthropicStream{w: w, cfg: cfg, msg: msg}
+	defer st.close()
+
+	err := runUpstream(ctx, cfg, upstreamReq, newAuthChain(cfg), thinking.ModeStrip, func(isReasoning bool, s string) bool {
+		kind, text, more := turn.accept(isReasoning, s)
+		st.delta(kind, text)
+		return more
+	})
+	if err != nil {
+		f, ok := describeUpstreamFailure(ctx, w, cfg, err)
+		if !ok {
+			return
+		}
+		if st.out == nil {
+			writeAnthropicError(w, f.Status, f.Message)
+			return
+		}
+		// 已开始输出：以 error 事件结束
+		data, _ := json.Marshal(anthropicError(f.Status, f.Message))
+		st.out.Event("error", data)
+		return
+	}
+	st.delta("text", turn.finish())
+
+	st.begin()
+	if st.index == 0 && st.current == "" {
+		// 没有任何内容时也输出一个空 text 块
+		st.open("text")
+	}
+	st.closeBlock()
+	reason, seq := anthropicStopReason(turn)
+	st.event("message_delta", map[string]any{
+		"type":  "message_delta",
+		"delta": map[string]any{"stop_reason": reason, "stop_sequence": seq},
+		"usage": map[string]int{"output_tokens": 0},
+	})
+	st.event("message_stop", map[string]string{"type": "message_stop"})
+	metrics.Completed.Add(1)
+	debugLog("Anthropic流式响应完成")
+}
+
+// begin 发送响应头与 message_start
+func (s *anthropicStream) begin() {
+	if s.out != nil {
+		return
+	}
+	s.w.Header().Set("Content-Type", "text/event-stream")
+	s.w.Header().Set("Cache-Control", "no-cache")
+	s.w.Header().Set("Connection", "keep-alive")
+	s.out = newSSEWriter(s.w, s.w.(http.Flusher), s.cfg.SSEHeartbeatInterval.D())
+	s.event("message_start", map[string]any{"type": "message_start", "message": s.msg})
+}
+
+// delta 输出一段内容，类型变化时关闭上一个内容块并打开新块
+func (s *anthropicStream) delta(kind, text string) {
+	if text == "" {
+		return
+	}
+	s.begin()
+	s.open(kind)
+	delta := map[string]string{"type": "text_delta", "text": text}
+	if kind == "thinking" {
+		delta = map[string]string{"type": "thinking_delta", "thinking": text}
+	}
+	s.event("content_block_delta", map[string]any{"type": "content_block_delta", "index": s.index, "delta": delta})
+}
+
+func (s *anthropicStream) open(kind string) {
+	if s.current == kind {
+		return
+	}
+	s.closeBlock()
+	s.current = kind
+	var block any = anthropicTextBlock{Type: "text"}
+	if kind == "thinking" {
+		block = anthropicThinkingBlock{Type: "thinking"}
+	}
+	s.event("content_block_start", map[string]any{"type": "content_block_start", "index": s.index, "content_block": block})
+}
+
+func (s *anthropicStream) closeBlock() {
+	if s.current == "" {
+		return
+	}
+	s.event("content_block_stop", map[string]any{"type": "content_block_stop", "index": s.index})
+	s.current = ""
+	s.index++
+}
+
+func (s *anthropicStream) event(name string, payload any) {
+	data, _ := json.Marshal(payload)
+	s.out.Event(name, data)
+}
+
+func (s *anthropicStream) close() {
+	if s.out != nil {
+		s.out.Close()
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+type ctxKey int
+
+const (
+	ctxKeyConfig ctxKey = iota
+	ctxKeyAPIKey
+)
+
+// configFromContext 获取请求开始时绑定的配置快照
+func configFromContext(ctx context.Context) *Config {
+	if cfg, ok := ctx.Value(ctxKeyConfig).(*Config); ok {
+		return cfg
+	}
+	return getConfig()
+}
+
+// apiKeyFromContext 获取通过鉴权的客户端密钥
+func apiKeyFromContext(ctx context.Context) *APIKey {
+	k, _ := ctx.Value(ctxKeyAPIKey).(*APIKey)
+	return k
+}
+
+// authenticate 校验明文密钥：先匹配配置中的默认key，再查询密钥存储
+func authenticate(cfg *Config, raw string) (*APIKey, error) {
+	if cfg.DefaultKey != "" && subtle.ConstantTimeCompare([]byte(raw), []byte(cfg.DefaultKey)) == 1 {
+		return &APIKey{ID: "default", Name: "default", Enabled: true}, nil
+	}
+	if cfg.KeysFile == "" {
+		return nil, errKeyNotFound
+	}
+	store, err := getKeyStore(cfg.KeysFile)
+	if err != nil {
+		debugLog("打开密钥文件失败: %v", err)
+		return nil, errKeyNotFound
+	}
+	return store.Lookup(raw)
+}
+
+// requestAPIKey 取客户端密钥：Authorization: Bearer、Anthropic 风格的 x-api-key，
+// 或 Gemini 风格的 x-goog-api-key（Gemini 接口还接受查询参数 key）
+func requestAPIKey(r *http.Request) (string, bool) {
+	if authHeader := r.Header.Get("Authorization"); strings.HasPrefix(authHeader, "Bearer ") {
+		return strings.TrimPrefix(authHeader, "Bearer "), true
+	}
+	for _, h := range []string{"x-api-key", "x-goog-api-key"} {
+		if key := r.Header.Get(h); key != "" {
+			return key, true
+		}
+	}
+	if strings.HasPrefix(r.URL.Path, "/v1beta/") {
+		if key := r.URL.Query().Get("key"); key != "" {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// apiErrorWriter 鉴权与限流中间件输出错误的方式，各接口使用自己的错误格式
+type apiErrorWriter func(w http.ResponseWriter, status int, errType, code, message string)
+
+// openAIErrors OpenAI 格式的错误
+func openAIErrors(w http.ResponseWriter, status int, errType, code, message string) {
+	writeOpenAIError(w, status, errType, code, message)
+}
+
+// withAuth 鉴权中间件：校验Bearer密钥，并将配置快照与密钥信息写入请求上下文；错误由 errs 按接口格式输出
+func withAuth(errs apiErrorWriter, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := getConfig()
+		ctx := context.WithValue(r.Context(), ctxKeyConfig, cfg)
+		if r.Method == "OPTIONS" {
+			next(w, r.WithContext(ctx))
+			return
+		}
+		setCORSHeaders(w)
+
+		// 限制请求体大小：声明的长度超限时直接拒绝，未声明长度时读取超限即解析失败
+		if r.ContentLength > int64(cfg.MaxRequestBytes) {
+			errs(w, http.StatusRequestEntityTooLarge, "invalid_request_error", "request_too_large",
+				fmt.Sprintf("Request body exceeds %d bytes.", cfg.MaxRequestBytes))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, int64(cfg.MaxRequestBytes))
+
+		apiKey, ok := requestAPIKey(r)
+		if !ok {
+			debugLog("缺少或无效的Authorization头")
+			errs(w, http.StatusUnauthorized, "invalid_request_error", "invalid_api_key", "Missing or invalid Authorization header")
+			return
+		}
+
+		key, err := authenticate(cfg, apiKey)
+		if err != nil {
+			debugLog("API key验证失败 (%s): %v", maskKey(apiKey), err)
+			switch {
+			case errors.Is(err, errKeyDisabled), errors.Is(err, errKeyExpired):
+				errs(w, http.StatusUnauthorized, "invalid_request_error", "invalid_api_key", err.Error())
+			default:
+				errs(w, http.StatusUnauthorized, "invalid_request_error", "invalid_api_key", "Invalid API key")
+			}
+			return
+		}
+
+		debugLog("API key验证通过 (id=%s, name=%s)", key.ID, key.Name)
+		ctx = context.WithValue(ctx, ctxKeyAPIKey, key)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// runKeysCommand 密钥管理子命令：keys add|list|enable|disable|remove
+func runKeysCommand(args []string) error {
+	usage := "用法: keys [-file keys.json] add|list|enable|disable|remove ..."
+	fs := flag.NewFlagSet("keys", flag.ContinueOnError)
+	file := fs.String("file", os.Getenv("KEYS_FILE"), "密钥文件路径（默认取 KEYS_FILE）")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return fmt.Errorf("未指定密钥文件\n%s", usage)
+	}
+	if fs.NArg() == 0 {
+		return errors.New(usage)
+	}
+	store, err := openKeyStore(*file)
+	if err != nil {
+		return err
+	}
+
+	cmd, rest := fs.Arg(0), fs.Args()[1:]
+	switch cmd {
+	case "add":
+		addFs := flag.NewFlagSet("keys add", flag.ContinueOnError)
+		name := addFs.String("name", "", "密钥名称")
+		owner := addFs.String("owner", "", "所有者")
+		models := addFs.String("models", "", "允许的模型，逗号分隔（为空不限制）")
+		ttl := addFs.Duration("ttl", 0, "有效期，如 720h（为0永不过期）")
+		rpm := addFs.Int("rpm", 0, "每分钟请求数限制（为0使用全局默认）")
+		concurrency := addFs.Int("concurrency", 0, "最大并发流（为0使用全局默认）")
+		reasoning := addFs.String("reasoning-format", "", "默认推理输出格式 reasoning_content/inline/hidden（为空使用全局默认）")
+		if err := addFs.Parse(rest); err != nil {
+			return err
+		}
+		k := APIKey{Name: *name, Owner: *owner, RPM: *rpm, MaxConcurrent: *concurrency}
+		if *reasoning != "" {
+			format, err := parseReasoningFormat(*reasoning)
+			if err != nil {
+				return err
+			}
+			k.ReasoningFormat = format
+		}
+		if *models != "" {
+			for _, m := range strings.Split(*models, ",") {
+				if m = strings.TrimSpace(m); m != "" {
+					k.AllowedModels = append(k.AllowedModels, m)
+				}
+			}
+		}
+		if *ttl > 0 {
+			exp := time.Now().Add(*ttl).UTC()
+			k.ExpiresAt = &exp
+		}
+		raw, created, err := store.Create(k)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("已创建密钥 id=%s name=%s\n%s\n（明文只显示这一次，请妥善保存）\n", created.ID, created.Name, raw)
+	case "list":
+		for _, k := range store.List() {
+			exp := "永不过期"
+			if k.ExpiresAt != nil {
+				exp = k.ExpiresAt.Format(time.RFC3339)
+			}
+			models := "*"
+			if len(k.AllowedModels) > 0 {
+				models = strings.Join(k.AllowedModels, ",")
+			}
+			reasoning := k.ReasoningFormat
+			if reasoning == "" {
+				reasoning = "default"
+			}
+			fmt.Printf("%s\t%s...\t%s\t%s\tenabled=%v\tmodels=%s\texpires=%s\trpm=%d\tconcurrency=%d\treasoning=%s\n",
+				k.ID, k.Prefix, k.Name, k.Owner, k.Enabled, models, exp, k.RPM, k.MaxConcurrent, reasoning)
+		}
+	case "enable", "disable":
+		if len(rest) != 1 {
+			return fmt.Errorf("用法: keys %s <id>", cmd)
+		}
+		enabled := cmd == "enable"
+		return store.Update(rest[0], func(k *APIKey) { k.Enabled = enabled })
+	case "remove":
+		if len(rest) != 1 {
+			return fmt.Errorf("用法: keys remove <id>")
+		}
+		return store.Delete(rest[0])
+	default:
+		return fmt.Errorf("未知子命令 %q\n%s", cmd, usage)
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 熔断器状态
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+var errCircuitOpen = errors.New("upstream circuit breaker is open")
+
+// BreakerStatus 熔断器状态（用于健康检查输出）
+type BreakerStatus struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+	RetryAt             *time.Time `json:"retry_at,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+}
+
+// CircuitBreaker 上游熔断器：连续失败达到阈值后打开，冷却后放行一个探测请求
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	state     string
+	failures  int
+	openedAt  time.Time
+	probing   bool
+	lastError string
+}
+
+var upstreamBreaker = &CircuitBreaker{state: BreakerClosed}
+
+// Allow 判断是否允许发起上游请求
+func (b *CircuitBreaker) Allow(cfg *Config) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < cfg.BreakerCooldown.D() {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+		debugLog("熔断器进入半开状态，放行探测请求")
+		return true
+	case BreakerHalfOpen:
+		// 半开状态只允许一个探测请求
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// Success 记录一次成功调用
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != BreakerClosed {
+		debugLog("上游恢复，熔断器关闭")
+	}
+	b.state = BreakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+// Release 放弃一次调用结果（如客户端取消），不影响熔断统计，仅释放半开探测名额
+func (b *CircuitBreaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// Failure 记录一次失败调用
+func (b *CircuitBreaker) Failure(cfg *Config, reason string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.lastError = reason
+	b.probing = false
+	if cfg.BreakerThreshold <= 0 {
+		return
+	}
+	if b.state == BreakerHalfOpen || b.failures >= cfg.BreakerThreshold {
+		if b.state != BreakerOpen {
+			debugLog("上游连续失败%d次，熔断器打开: %s", b.failures, reason)
+		}
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// Status 返回熔断器状态快照
+func (b *CircuitBreaker) Status(cfg *Config) BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := BreakerStatus{State: b.state, ConsecutiveFailures: b.failures, LastError: b.lastError}
+	if b.state != BreakerClosed {
+		opened := b.openedAt
+		retry := opened.Add(cfg.BreakerCooldown.D())
+		s.OpenedAt, s.RetryAt = &opened, &retry
+	}
+	return s
+}
+
+// retryAfter 熔断器打开时距下次探测的等待时间
+func (b *CircuitBreaker) retryAfter(cfg *Config) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if d := cfg.BreakerCooldown.D() - time.Since(b.openedAt); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// isRetryableStatus 可重试的上游状态码
+func isRetryableStatus(status int) bool {
+	switch status {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryBackoff 带抖动的指数退避
+func retryBackoff(cfg *Config, attempt int) time.Duration {
+	d := cfg.RetryBackoff.D() << attempt
+	if max := cfg.RetryMaxBackoff.D(); d > max || d <= 0 {
+		d = max
+	}
+	// 在 [d/2, d) 之间随机，避免多个请求同时重试
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// callUpstreamWithRetry 对连接错误与可重试状态码按退避策略重试，并经过熔断器
+// 仅在向下游写出任何内容之前调用
+func callUpstreamWithRetry(ctx context.Context, cfg *Config, upstreamReq UpstreamRequest, chatID string, authToken string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if !upstreamBreaker.Allow(cfg) {
+			return nil, errCircuitOpen
+		}
+		resp, err := callUpstreamWithHeaders(ctx, cfg, upstreamReq, chatID, authToken)
+		var reason string
+		switch {
+		case ctx.Err() != nil:
+			// 客户端已断开，不计入熔断失败，也不再重试
+			upstreamBreaker.Release()
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return nil, context.Cause(ctx)
+		case err != nil:
+			reason = err.Error()
+		case isRetryableStatus(resp.StatusCode):
+			reason = resp.Status
+		default:
+			upstreamBreaker.Success()
+			return resp, nil
+		}
+		upstreamBreaker.Failure(cfg, reason)
+
+		if attempt >= cfg.UpstreamRetries {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		wait := retryBackoff(cfg, attempt)
+		debugLog("上游调用失败 (%s)，%v后第%d次重试", reason, wait, attempt+1)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		}
+	}
+}
+
+// writeUpstreamFailure 上游调用失败时向客户端返回错误；熔断时快速返回503
+// 超时返回504；客户端已断开时只计数，不再写响应
+func writeUpstreamFailure(ctx context.Context, w http.ResponseWriter, cfg *Config, err error) {
+	f, ok := describeUpstreamFailure(ctx, w, cfg, err)
+	if !ok {
+		return
+	}
+	writeOpenAIError(w, f.Status, f.Type, f.Code, f.Message)
+}
+
+// upstreamFailure 上游调用失败对应的状态码与错误信息，由各API格式自行编码
+type upstreamFailure struct {
+	Status  int
+	Type    string // OpenAI 错误类型
+	Code    string
+	Message string
+}
+
+// describeUpstreamFailure 统计失败并给出返回给客户端的错误（熔断时设置 Retry-After）；
+// 客户端已断开时只计数，返回 false
+func describeUpstreamFailure(ctx context.Context, w http.ResponseWriter, cfg *Config, err error) (upstreamFailure, bool) {
+	if clientGone(ctx) {
+		metrics.ClientCancellations.Add(1)
+		debugLog("客户端已断开，放弃上游调用: %v", err)
+		return upstreamFailure{}, false
+	}
+	metrics.UpstreamErrors.Add(1)
+	if te, ok := asTimeout(err); ok {
+		metrics.UpstreamTimeouts.Add(1)
+		return upstreamFailure{http.StatusGatewayTimeout, "timeout", te.Code, "Upstream request timed out: " + te.Error()}, true
+	}
+	if errors.Is(err, errCircuitOpen) {
+		wait := upstreamBreaker.retryAfter(cfg)
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		return upstreamFailure{http.StatusServiceUnavailable, "server_error", "upstream_unavailable",
+			"Upstream is temporarily unavailable (circuit breaker open). Please retry later."}, true
+	}
+	var se *upstreamStatusError
+	if errors.As(err, &se) {
+		return upstreamFailure{http.StatusBadGateway, "server_error", "upstream_error", "Upstream returned " + se.Status + "."}, true
+	}
+	var ae *upstreamAuthError
+	if errors.As(err, &ae) {
+		return upstreamFailure{http.StatusBadGateway, "server_error", "upstream_auth_rejected",
+			"Upstream rejected all credentials (last status: " + ae.Status + ")."}, true
+	}
+	if errors.Is(err, errNoUpstreamAuth) {
+		return upstreamFailure{http.StatusServiceUnavailable, "server_error", "upstream_auth_unavailable", "No upstream credential is available."}, true
+	}
+	return upstreamFailure{http.StatusBadGateway, "server_error", "upstream_error", "Failed to call upstream."}, true
+}
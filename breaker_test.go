@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	cfg := &Config{BreakerThreshold: 3, BreakerCooldown: Duration(time.Minute)}
+	b := &CircuitBreaker{state: BreakerClosed}
+
+	// 连续失败未达到阈值时保持关闭，成功后计数清零
+	b.Failure(cfg, "e1")
+	b.Failure(cfg, "e2")
+	b.Success()
+	b.Failure(cfg, "e3")
+	b.Failure(cfg, "e4")
+	if s := b.Status(cfg); s.State != BreakerClosed || s.ConsecutiveFailures != 2 || !b.Allow(cfg) {
+		t.Fatalf("未达阈值时 = %+v", s)
+	}
+
+	// 达到阈值后打开，冷却期内拒绝请求
+	b.Failure(cfg, "e5")
+	s := b.Status(cfg)
+	if s.State != BreakerOpen || s.LastError != "e5" || s.RetryAt == nil {
+		t.Fatalf("达到阈值后 = %+v", s)
+	}
+	if b.Allow(cfg) {
+		t.Fatal("冷却期内应拒绝")
+	}
+	if d := b.retryAfter(cfg); d <= 0 || d > time.Minute {
+		t.Fatalf("retryAfter = %v", d)
+	}
+
+	// 冷却结束后半开，只放行一个探测请求
+	b.openedAt = time.Now().Add(-2 * time.Minute)
+	if !b.Allow(cfg) || b.Status(cfg).State != BreakerHalfOpen {
+		t.Fatal("冷却结束后应进入半开并放行探测")
+	}
+	if b.Allow(cfg) {
+		t.Fatal("半开状态只允许一个探测请求")
+	}
+
+	// 探测被取消时释放名额，不改变状态
+	b.Release()
+	if !b.Allow(cfg) || b.Status(cfg).State != BreakerHalfOpen {
+		t.Fatal("Release 后应能再次探测")
+	}
+
+	// 探测失败立即重新打开
+	b.Failure(cfg, "probe failed")
+	if b.Status(cfg).State != BreakerOpen || b.Allow(cfg) {
+		t.Fatal("探测失败后应重新打开")
+	}
+
+	// 探测成功后关闭
+	b.openedAt = time.Now().Add(-2 * time.Minute)
+	if !b.Allow(cfg) {
+		t.Fatal("应放行探测")
+	}
+	b.Success()
+	if s := b.Status(cfg); s.State != BreakerClosed || s.ConsecutiveFailures != 0 || s.OpenedAt != nil || !b.Allow(cfg) {
+		t.Fatalf("探测成功后 = %+v", s)
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	cfg := &Config{BreakerThreshold: 0, BreakerCooldown: Duration(time.Minute)}
+	b := &CircuitBreaker{state: BreakerClosed}
+	for i := 0; i < 100; i++ {
+		b.Failure(cfg, "e")
+	}
+	if !b.Allow(cfg) || b.Status(cfg).State != BreakerClosed {
+		t.Fatal("threshold=0 时不应熔断")
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	cfg := &Config{RetryBackoff: Duration(100 * time.Millisecond), RetryMaxBackoff: Duration(time.Second)}
+	for attempt, base := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		for i := 0; i < 20; i++ {
+			if d := retryBackoff(cfg, attempt); d < base/2 || d > base {
+				t.Fatalf("attempt %d: %v 不在 [%v, %v] 内", attempt, d, base/2, base)
+			}
+		}
+	}
+	// 移位溢出时取上限
+	if d := retryBackoff(cfg, 80); d < 500*time.Millisecond || d > time.Second {
+		t.Fatalf("attempt 80: %v", d)
+	}
+}
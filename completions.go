@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"z2api/thinking"
+)
+
+// 旧版 /v1/completions：每个 prompt 包装为一条 user 消息，返回 text_completion 对象。
+// prompt 为数组时并发调用上游，每个 prompt 对应一个 choice；思考内容不输出
+
+// completionFanout 数组 prompt 同时进行的上游对话数
+const completionFanout = 4
+
+// CompletionRequest 旧版补全请求
+type CompletionRequest struct {
+	Model     string          `json:"model"`
+	Prompt    json.RawMessage `json:"prompt"` // 字符串或字符串数组
+	Suffix    string          `json:"suffix,omitempty"`
+	Echo      bool            `json:"echo,omitempty"`
+	Stop      json.RawMessage `json:"stop,omitempty"` // 字符串或字符串数组
+	MaxTokens int             `json:"max_tokens,omitempty"`
+	Stream    bool            `json:"stream,omitempty"`
+}
+
+// TextCompletionResponse text_completion 对象（流式chunk使用相同结构）
+type TextCompletionResponse struct {
+	ID      string       `json:"id"`
+	Object  string       `json:"object"`
+	Created int64        `json:"created"`
+	Model   string       `json:"model"`
+	Choices []TextChoice `json:"choices"`
+	Usage   *Usage       `json:"usage,omitempty"`
+}
+
+// TextChoice 补全结果；流式时 finish_reason 在最后一个chunk之前为 null
+type TextChoice struct {
+	Text         string  `json:"text"`
+	Index        int     `json:"index"`
+	Logprobs     any     `json:"logprobs"`
+	FinishReason *string `json:"finish_reason"`
+}
+
+// stringOrList 解析字符串或字符串数组字段
+func stringOrList(raw json.RawMessage, field string) ([]string, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	if raw[0] == '"' {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, fmt.Errorf("%s: %v", field, err)
+		}
+		return []string{s}, nil
+	}
+	var list []string
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, fmt.Errorf("%s must be a string or an array of strings (token arrays are not supported)", field)
+	}
+	return list, nil
+}
+
+// insertionPrompt 有 suffix 时要求模型只输出衔接前后文的部分
+func insertionPrompt(suffix string) string {
+	return "# Insertion\n\nThe user message is the beginning of a text. Output only the text that belongs between it and the following ending, without repeating either part.\n<ending>\n" + suffix + "\n</ending>"
+}
+
+// completionTask 一个 prompt 的上游对话
+type completionTask struct {
+	index  int
+	prompt string
+	req    UpstreamRequest
+	limits *turnLimits
+	text   strings.Builder
+}
+
+func (t *completionTask) finishReason() *string {
+	reason := "stop"
+	if t.limits.contentBudget.exhausted() {
+		reason = "length"
+	}
+	return &reason
+}
+
+func handleCompletions(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	debugLog("收到completions请求")
+	metrics.Requests.Add(1)
+
+	cfg := configFromContext(r.Context())
+	apiKey := apiKeyFromContext(r.Context())
+
+	var req CompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		debugLog("JSON解析失败: %v", err)
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_json", "Invalid JSON: "+err.Error())
+		return
+	}
+	if !apiKey.allowsModel(req.Model) {
+		debugLog("密钥 %s 无权访问模型: %s", apiKey.ID, req.Model)
+		writeOpenAIError(w, http.StatusForbidden, "invalid_request_error", "model_not_allowed", "Model not allowed for this API key")
+		return
+	}
+	prompts, err := stringOrList(req.Prompt, "prompt")
+	if err == nil && len(prompts) == 0 {
+		err = fmt.Errorf("prompt is required")
+	}
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_prompt", err.Error())
+		return
+	}
+	if len(prompts) > cfg.MaxCompletionPrompts {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "too_many_prompts",
+			fmt.Sprintf("Too many prompts: %d (maximum %d per request).", len(prompts), cfg.MaxCompletionPrompts))
+		return
+	}
+	stops, err := stringOrList(req.Stop, "stop")
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_stop", err.Error())
+		return
+	}
+	// 每个 prompt 是一次上游对话，校验全部通过后限流按 prompt 计数（withRateLimit 已计入一次）
+	if !chargeRequests(w, r, openAIErrors, len(prompts)-1) {
+		return
+	}
+	debugLog("请求解析成功 - 模型: %s, 流式: %v, prompt数: %d, echo: %v, 停止序列: %d个", req.Model, req.Stream, len(prompts), req.Echo, len(stops))
+
+	isThinking, isSearch := modelFeatures(req.Model)
+	tasks := make([]*completionTask, len(prompts))
+	for i, prompt := range prompts {
+		messages := []Message{{Role: "user", Content: prompt}}
+		if req.Suffix != "" {
+			messages = appendSystemPrompt(messages, insertionPrompt(req.Suffix))
+		}
+		upstreamReq := newUpstreamRequest(cfg, messages, nil, isThinking, isSearch)
+		if req.MaxTokens > 0 {
+			upstreamReq.Params["max_tokens"] = req.MaxTokens
+		}
+		if len(stops) > 0 {
+			upstreamReq.Params["stop"] = stops
+		}
+		tasks[i] = &completionTask{
+			index:  i,
+			prompt: prompt,
+			req:    upstreamReq,
+			limits: &turnLimits{contentBudget: newTokenBudget(req.MaxTokens), stop: newStopMatcher(stops)},
+		}
+	}
+
+	ctx, cancel := withUpstreamDeadlines(r.Context(), resolveDeadlines(cfg, req.Model, r.Header))
+	defer cancel()
+
+	resp := TextCompletionResponse{
+		ID:      fmt.Sprintf("cmpl-%d", time.Now().UnixNano()),
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+	}
+	if req.Stream {
+		handleCompletionsStream(ctx, w, cfg, tasks, req.Echo, resp)
+		return
+	}
+
+	if err := runCompletionTasks(ctx, cfg, tasks, func(t *completionTask, text string) bool {
+		t.text.WriteString(text)
+		return true
+	}); err != nil {
+		writeUpstreamFailure(ctx, w, cfg, err)
+		return
+	}
+	for _, t := range tasks {
+		text := t.text.String()
+		if req.Echo {
+			text = t.prompt + text
+		}
+		resp.Choices = append(resp.Choices, TextChoice{Text: text, Index: t.index, FinishReason: t.finishReason()})
+	}
+	resp.Usage = &Usage{}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+	metrics.Completed.Add(1)
+	debugLog("completions非流式响应发送完成")
+}
+
+// runCompletionTasks 并发执行全部对话，把回答增量交给 emit（调用方需自行处理并发）；
+// 任一对话失败时取消其余对话并返回第一个错误
+func runCompletionTasks(ctx context.Context, cfg *Config, tasks []*completionTask, emit func(t *completionTask, text string) bool) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	sem := make(chan struct{}, completionFanout)
+	for _, t := range tasks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				return
+			}
+			err := runUpstream(ctx, cfg, t.req, newAuthChain(cfg), thinking.ModeStrip, func(isReasoning bool, s string) bool {
+				kind, text, more := t.limits.accept(isReasoning, s)
+				if kind == "text" && text != "" && !emit(t, text) {
+					return false
+				}
+				return more
+			})
+			if err == nil {
+				if rest := t.limits.finish(); rest != "" {
+					emit(t, rest)
+				}
+				return
+			}
+			once.Do(func() {
+				firstErr = err
+				cancel(err)
+			})
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// handleCompletionsStream 流式输出：各 prompt 的chunk按到达顺序交错发送，以 index 区分。
+// 首个chunk在收到首个增量时才发送，上游在输出前失败时仍返回HTTP错误；之后的失败以错误事件结束
+func handleCompletionsStream(ctx context.Context, w http.ResponseWriter, cfg *Config, tasks []*completionTask, echo bool, resp TextCompletionResponse) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	var mu sync.Mutex
+	var out *sseWriter
+	write := func(choice TextChoice) {
+		chunk := resp
+		chunk.Choices = []TextChoice{choice}
+		data, _ := json.Marshal(chunk)
+		out.Data(data)
+	}
+	begin := func() {
+		if out != nil {
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		out = newSSEWriter(w, flusher, cfg.SSEHeartbeatInterval.D())
+		if echo {
+			for _, t := range tasks {
+				write(TextChoice{Text: t.prompt, Index: t.index})
+			}
+		}
+	}
+
+	err := runCompletionTasks(ctx, cfg, tasks, func(t *completionTask, text string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		begin()
+		write(TextChoice{Text: text, Index: t.index})
+		return true
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if err != nil && out == nil {
+		writeUpstreamFailure(ctx, w, cfg, err)
+		return
+	}
+	begin()
+	defer out.Close()
+	if err != nil {
+		f, ok := describeUpstreamFailure(ctx, w, cfg, err)
+		if !ok {
+			return
+		}
+		data, _ := json.Marshal(map[string]OpenAIError{
+			"error": {Message: f.Message, Type: f.Type, Code: f.Code},
+		})
+		out.Data(data)
+		out.Data([]byte("[DONE]"))
+		return
+	}
+	for _, t := range tasks {
+		write(TextChoice{Index: t.index, FinishReason: t.finishReason()})
+	}
+	out.Data([]byte("[DONE]"))
+	metrics.Completed.Add(1)
+	debugLog("completions流式响应完成")
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"z2api/thinking"
+)
+
+// Config 运行时配置
+// 优先级（由低到高）：内置默认值 < 配置文件 < 环境变量 < 命令行参数
+type Config struct {
+	UpstreamUrl   string `yaml:"upstream_url" json:"upstream_url"`
+	DefaultKey    string `yaml:"default_key" json:"default_key" secret:"true"`       // 下游客户端鉴权key
+	UpstreamToken string `yaml:"upstream_token" json:"upstream_token" secret:"true"` // 上游API的token（回退用）
+
+	UpstreamAccounts []UpstreamAccount `yaml:"upstream_accounts" json:"upstream_accounts" secret:"true"` // 多个上游账号，按权重轮换
+	AccountCooldown  Duration          `yaml:"account_cooldown" json:"account_cooldown"`                 // 账号被上游拒绝后的冷却时间
+
+	TokenRefreshMargin Duration `yaml:"token_refresh_margin" json:"token_refresh_margin"` // token距过期小于该时长时提前替换/告警
+
+	UpstreamRetries  int      `yaml:"upstream_retries" json:"upstream_retries"`   // 连接错误与5xx的重试次数
+	RetryBackoff     Duration `yaml:"retry_backoff" json:"retry_backoff"`         // 首次重试的退避时长，之后指数增长
+	RetryMaxBackoff  Duration `yaml:"retry_max_backoff" json:"retry_max_backoff"` // 单次退避上限
+	BreakerThreshold int      `yaml:"breaker_threshold" json:"breaker_threshold"` // 连续失败多少次后熔断，0表示关闭熔断
+	BreakerCooldown  Duration `yaml:"breaker_cooldown" json:"breaker_cooldown"`   // 熔断后多久放行探测请求
+
+	StreamRecoveryAttempts int `yaml:"stream_recovery_attempts" json:"stream_recovery_attempts"` // 流在输出内容前中断时的最大重放次数
+
+	StructuredOutputRetries int `yaml:"structured_output_retries" json:"structured_output_retries"` // 结构化输出校验失败后要求模型修正的次数，0表示不修正
+
+	MaxCompletionPrompts int `yaml:"max_completion_prompts" json:"max_completion_prompts"` // /v1/completions 单个请求最多的 prompt 数
+
+	VisionModel   string `yaml:"vision_model" json:"vision_model"`       // 请求含图片时使用的上游模型ID，为空时不接受图片
+	MaxImageBytes int    `yaml:"max_image_bytes" json:"max_image_bytes"` // 单张图片的最大字节数
+
+	MaxRequestBytes int `yaml:"max_request_bytes" json:"max_request_bytes"` // 请求体的最大字节数
+
+	ResponseStoreTTL  Duration `yaml:"response_store_ttl" json:"response_store_ttl"`   // /v1/responses 响应的保存时长
+	ResponseStoreSize int      `yaml:"response_store_size" json:"response_store_size"` // 最多保存的响应数，0表示不保存
+
+	SessionTTL      Duration `yaml:"session_ttl" json:"session_ttl"`             // 会话空闲多久后失效
+	SessionMax      int      `yaml:"session_max" json:"session_max"`             // 最多保存的会话数，0表示关闭会话
+	SessionFromUser bool     `yaml:"session_from_user" json:"session_from_user"` // 是否把请求的 user 字段作为会话ID
+
+	UpstreamConnectTimeout   Duration            `yaml:"upstream_connect_timeout" json:"upstream_connect_timeout"`       // 建立连接超时
+	UpstreamFirstByteTimeout Duration            `yaml:"upstream_first_byte_timeout" json:"upstream_first_byte_timeout"` // 发出请求到收到首个字节的超时
+	UpstreamIdleTimeout      Duration            `yaml:"upstream_idle_timeout" json:"upstream_idle_timeout"`             // 流式响应两次数据之间的最大间隔
+	UpstreamTotalTimeout     Duration            `yaml:"upstream_total_timeout" json:"upstream_total_timeout"`           // 单个请求的总时长（含重试与重放）
+	ModelTimeouts            map[string]Duration `yaml:"model_timeouts" json:"model_timeouts"`                           // 按模型覆盖总时长
+
+	SSEHeartbeatInterval Duration `yaml:"sse_heartbeat_interval" json:"sse_heartbeat_interval"` // 流式响应空闲时发送心跳的间隔，0表示关闭
+
+	KeysFile         string `yaml:"keys_file" json:"keys_file"`   // 客户端密钥存储文件（多密钥）
+	ModelName        string `yaml:"model_name" json:"model_name"` // 对外展示的模型名称
+	Port             string `yaml:"port" json:"port"`
+	DebugMode        bool   `yaml:"debug_mode" json:"debug_mode"`                   // debug模式开关
+	ThinkTagsMode    string `yaml:"think_tags_mode" json:"think_tags_mode"`         // strip: 去除<details>标签；think: 转为<think>标签；raw: 保留原样
+	ReasoningFormat  string `yaml:"reasoning_format" json:"reasoning_format"`       // 默认推理输出格式: reasoning_content/inline/hidden
+	AnonTokenEnabled bool   `yaml:"anon_token_enabled" json:"anon_token_enabled"`   // 匿名token开关
+	AnonPoolSize     int    `yaml:"anon_pool_size" json:"anon_pool_size"`           // 预取并保持的匿名token数量
+	AnonTokenPolicy  string `yaml:"anon_token_policy" json:"anon_token_policy"`     // single/reuse/until-error
+	AnonTokenMaxUses int    `yaml:"anon_token_max_uses" json:"anon_token_max_uses"` // reuse策略下每个token的最大使用次数
+	AdminKey         string `yaml:"admin_key" json:"admin_key" secret:"true"`       // 管理接口密钥，为空时关闭管理接口
+
+	RateLimitRPM         int `yaml:"rate_limit_rpm" json:"rate_limit_rpm"`                 // 每个密钥默认每分钟请求数，0表示不限制
+	MaxConcurrentStreams int `yaml:"max_concurrent_streams" json:"max_concurrent_streams"` // 每个密钥默认最大并发流，0表示不限制
+
+	ConfigFile    string    `yaml:"-" json:"-"` // 本次加载使用的配置文件路径
+	ConfigModTime time.Time `yaml:"-" json:"-"` // 加载时配置文件的修改时间
+}
+
+// configField 描述一个可由环境变量和命令行参数设置的配置项
+type configField struct {
+	flag  string
+	env   string
+	usage string
+	set   func(c *Config, v string) error
+}
+
+// boolFlags 布尔型参数，命令行中可省略取值（如 -debug）
+var boolFlags = map[string]bool{"debug": true, "anon-token": true, "session-from-user": true}
+
+var configFields = []configField{
+	{"upstream-url", "UPSTREAM_URL", "上游API地址", func(c *Config, v string) error { c.UpstreamUrl = v; return nil }},
+	{"default-key", "DEFAULT_KEY", "下游客户端鉴权key", func(c *Config, v string) error { c.DefaultKey = v; return nil }},
+	{"token-refresh-margin", "TOKEN_REFRESH_MARGIN", "token距过期小于该时长时提前替换，如 5m", func(c *Config, v string) error { return c.TokenRefreshMargin.Set(v) }},
+	{"upstream-retries", "UPSTREAM_RETRIES", "连接错误与5xx的重试次数", func(c *Config, v string) error { return parseInt(v, &c.UpstreamRetries) }},
+	{"retry-backoff", "RETRY_BACKOFF", "首次重试的退避时长", func(c *Config, v string) error { return c.RetryBackoff.Set(v) }},
+	{"retry-max-backoff", "RETRY_MAX_BACKOFF", "单次退避上限", func(c *Config, v string) error { return c.RetryMaxBackoff.Set(v) }},
+	{"breaker-threshold", "BREAKER_THRESHOLD", "连续失败多少次后熔断，0表示关闭", func(c *Config, v string) error { return parseInt(v, &c.BreakerThreshold) }},
+	{"breaker-cooldown", "BREAKER_COOLDOWN", "熔断后多久放行探测请求", func(c *Config, v string) error { return c.BreakerCooldown.Set(v) }},
+	{"stream-recovery-attempts", "STREAM_RECOVERY_ATTEMPTS", "流在输出内容前中断时的最大重放次数", func(c *Config, v string) error { return parseInt(v, &c.StreamRecoveryAttempts) }},
+	{"vision-model", "VISION_MODEL", "请求含图片时使用的上游模型ID，为空时不接受图片", func(c *Config, v string) error { c.VisionModel = v; return nil }},
+	{"max-image-bytes", "MAX_IMAGE_BYTES", "单张图片的最大字节数", func(c *Config, v string) error { return parseInt(v, &c.MaxImageBytes) }},
+	{"max-request-bytes", "MAX_REQUEST_BYTES", "请求体的最大字节数", func(c *Config, v string) error { return parseInt(v, &c.MaxRequestBytes) }},
+	{"response-store-ttl", "RESPONSE_STORE_TTL", "/v1/responses 响应的保存时长", func(c *Config, v string) error { return c.ResponseStoreTTL.Set(v) }},
+	{"response-store-size", "RESPONSE_STORE_SIZE", "最多保存的响应数，0表示不保存", func(c *Config, v string) error { return parseInt(v, &c.ResponseStoreSize) }},
+	{"session-ttl", "SESSION_TTL", "会话空闲多久后失效", func(c *Config, v string) error { return c.SessionTTL.Set(v) }},
+	{"session-max", "SESSION_MAX", "最多保存的会话数，0表示关闭会话", func(c *Config, v string) error { return parseInt(v, &c.SessionMax) }},
+	{"session-from-user", "SESSION_FROM_USER", "把请求的 user 字段作为会话ID", func(c *Config, v string) error { return parseBool(v, &c.SessionFromUser) }},
+	{"structured-output-retries", "STRUCTURED_OUTPUT_RETRIES", "结构化输出校验失败后要求模型修正的次数", func(c *Config, v string) error { return parseInt(v, &c.StructuredOutputRetries) }},
+	{"max-completion-prompts", "MAX_COMPLETION_PROMPTS", "/v1/completions 单个请求最多的 prompt 数", func(c *Config, v string) error { return parseInt(v, &c.MaxCompletionPrompts) }},
+	{"upstream-connect-timeout", "UPSTREAM_CONNECT_TIMEOUT", "建立连接超时，0表示不限制", func(c *Config, v string) error { return c.UpstreamConnectTimeout.Set(v) }},
+	{"upstream-first-byte-timeout", "UPSTREAM_FIRST_BYTE_TIMEOUT", "首字节超时，0表示不限制", func(c *Config, v string) error { return c.UpstreamFirstByteTimeout.Set(v) }},
+	{"upstream-idle-timeout", "UPSTREAM_IDLE_TIMEOUT", "流式响应空闲超时，0表示不限制", func(c *Config, v string) error { return c.UpstreamIdleTimeout.Set(v) }},
+	{"upstream-total-timeout", "UPSTREAM_TOTAL_TIMEOUT", "单个请求总时长，0表示不限制", func(c *Config, v string) error { return c.UpstreamTotalTimeout.Set(v) }},
+	{"sse-heartbeat-interval", "SSE_HEARTBEAT_INTERVAL", "流式响应空闲时发送心跳的间隔，0表示关闭", func(c *Config, v string) error { return c.SSEHeartbeatInterval.Set(v) }},
+	{"keys-file", "KEYS_FILE", "客户端密钥存储文件", func(c *Config, v string) error { c.KeysFile = v; return nil }},
+	{"upstream-token", "UPSTREAM_TOKEN", "上游API的token（回退用）", func(c *Config, v string) error { c.UpstreamToken = v; return nil }},
+	{"upstream-tokens", "UPSTREAM_TOKENS", "多个上游账号，格式 token[:weight],...", parseUpstreamTokens},
+	{"account-cooldown", "ACCOUNT_COOLDOWN", "账号被拒绝后的冷却时间，如 60s", func(c *Config, v string) error { return c.AccountCooldown.Set(v) }},
+	{"model-name", "MODEL_NAME", "对外展示的模型名称", func(c *Config, v string) error { c.ModelName = v; return nil }},
+	{"port", "PORT", "服务监听端口", func(c *Config, v string) error { c.Port = v; return nil }},
+	{"debug", "DEBUG_MODE", "debug模式开关", func(c *Config, v string) error { return parseBool(v, &c.DebugMode) }},
+	{"reasoning-format", "REASONING_FORMAT", "默认推理输出格式: reasoning_content/inline/hidden", func(c *Config, v string) error { c.ReasoningFormat = v; return nil }},
+	{"think-tags-mode", "THINK_TAGS_MODE", "思考内容处理策略: think/strip/raw", func(c *Config, v string) error { c.ThinkTagsMode = v; return nil }},
+	{"anon-token", "ANON_TOKEN_ENABLED", "匿名token开关", func(c *Config, v string) error { return parseBool(v, &c.AnonTokenEnabled) }},
+	{"anon-pool-size", "ANON_POOL_SIZE", "预取的匿名token数量", func(c *Config, v string) error { return parseInt(v, &c.AnonPoolSize) }},
+	{"anon-token-policy", "ANON_TOKEN_POLICY", "匿名token复用策略: single/reuse/until-error", func(c *Config, v string) error { c.AnonTokenPolicy = v; return nil }},
+	{"anon-token-max-uses", "ANON_TOKEN_MAX_USES", "reuse策略下每个token的最大使用次数", func(c *Config, v string) error { return parseInt(v, &c.AnonTokenMaxUses) }},
+	{"admin-key", "ADMIN_KEY", "管理接口密钥", func(c *Config, v string) error { c.AdminKey = v; return nil }},
+	{"rate-limit-rpm", "RATE_LIMIT_RPM", "每个密钥默认每分钟请求数", func(c *Config, v string) error { return parseInt(v, &c.RateLimitRPM) }},
+	{"max-concurrent-streams", "MAX_CONCURRENT_STREAMS", "每个密钥默认最大并发流", func(c *Config, v string) error { return parseInt(v, &c.MaxConcurrentStreams) }},
+}
+
+func parseBool(v string, dst *bool) error {
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("无效的布尔值 %q", v)
+	}
+	*dst = b
+	return nil
+}
+
+func parseInt(v string, dst *int) error {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("无效的整数 %q", v)
+	}
+	*dst = n
+	return nil
+}
+
+// parseUpstreamTokens 解析 token[:weight],... 形式的账号列表
+func parseUpstreamTokens(c *Config, v string) error {
+	var accounts []UpstreamAccount
+	for i, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		acc := UpstreamAccount{Name: fmt.Sprintf("account-%d", i+1), Token: item, Weight: 1}
+		if idx := strings.LastIndex(item, ":"); idx > 0 {
+			w, err := strconv.Atoi(item[idx+1:])
+			if err != nil {
+				return fmt.Errorf("无效的账号权重 %q", item[idx+1:])
+			}
+			acc.Token, acc.Weight = item[:idx], w
+		}
+		accounts = append(accounts, acc)
+	}
+	c.UpstreamAccounts = accounts
+	return nil
+}
+
+// Duration 配置中的时长，支持 "30s"、"5m" 形式的字符串或以秒为单位的数字
+type Duration time.Duration
+
+// D 转换为 time.Duration
+func (d Duration) D() time.Duration { return time.Duration(d) }
+
+func (d Duration) String() string { return time.Duration(d).String() }
+
+// Set 从字符串解析时长
+func (d *Duration) Set(v string) error {
+	if n, err := strconv.ParseFloat(v, 64); err == nil {
+		*d = Duration(n * float64(time.Second))
+		return nil
+	}
+	v2, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("无效的时长 %q", v)
+	}
+	*d = Duration(v2)
+	return nil
+}
+
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error { return d.Set(node.Value) }
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	return d.Set(strings.Trim(string(data), `"`))
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) { return json.Marshal(d.String()) }
+
+// defaultConfig 内置默认配置
+func defaultConfig() *Config {
+	return &Config{
+		UpstreamUrl:      "https://chat.z.ai/api/chat/completions",
+		DefaultKey:       "",
+		ModelName:        DefaultModelName,
+		Port:             "8080",
+		DebugMode:        false,
+		ThinkTagsMode:    thinking.ModeThink,
+		ReasoningFormat:  ReasoningFormatSeparate,
+		AnonTokenEnabled: true,
+		AnonPoolSize:     4,
+		AnonTokenPolicy:  TokenPolicySingle,
+		AnonTokenMaxUses: 5,
+		AccountCooldown:  Duration(60 * time.Second),
+
+		TokenRefreshMargin: Duration(5 * time.Minute),
+
+		UpstreamRetries:  2,
+		RetryBackoff:     Duration(500 * time.Millisecond),
+		RetryMaxBackoff:  Duration(5 * time.Second),
+		BreakerThreshold: 5,
+		BreakerCooldown:  Duration(30 * time.Second),
+
+		StreamRecoveryAttempts: 2,
+
+		StructuredOutputRetries: 1,
+
+		MaxCompletionPrompts: 16,
+
+		VisionModel:   "glm-4.5v",
+		MaxImageBytes: 10 << 20,
+
+		MaxRequestBytes: 50 << 20,
+
+		ResponseStoreTTL:  Duration(time.Hour),
+		ResponseStoreSize: 1000,
+
+		SessionTTL: Duration(30 * time.Minute),
+		SessionMax: 1000,
+
+		UpstreamConnectTimeout:   Duration(10 * time.Second),
+		UpstreamFirstByteTimeout: Duration(60 * time.Second),
+		UpstreamIdleTimeout:      Duration(120 * time.Second),
+		UpstreamTotalTimeout:     Duration(10 * time.Minute),
+
+		SSEHeartbeatInterval: Duration(15 * time.Second),
+	}
+}
+
+// loadConfig 按优先级合并默认值、配置文件、环境变量与命令行参数
+func loadConfig(args []string) (*Config, error) {
+	fs := flag.NewFlagSet("z2api", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("CONFIG_FILE"), "配置文件路径（YAML或JSON），也可通过 CONFIG_FILE 设置")
+	for _, f := range configFields {
+		usage := fmt.Sprintf("%s（环境变量 %s）", f.usage, f.env)
+		if boolFlags[f.flag] {
+			fs.Bool(f.flag, false, usage)
+		} else {
+			fs.String(f.flag, "", usage)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	c := defaultConfig()
+	if *configPath != "" {
+		if err := c.loadFile(*configPath); err != nil {
+			return nil, err
+		}
+		c.ConfigFile = *configPath
+	}
+
+	for _, f := range configFields {
+		if v, ok := os.LookupEnv(f.env); ok && v != "" {
+			if err := f.set(c, v); err != nil {
+				return nil, fmt.Errorf("环境变量 %s: %w", f.env, err)
+			}
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(fl *flag.Flag) {
+		for _, f := range configFields {
+			if f.flag == fl.Name && flagErr == nil {
+				if err := f.set(c, fl.Value.String()); err != nil {
+					flagErr = fmt.Errorf("参数 -%s: %w", f.flag, err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, flagErr
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadFile 读取配置文件，按扩展名选择JSON或YAML解析
+func (c *Config) loadFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("读取配置文件失败: %w", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("读取配置文件失败: %w", err)
+	}
+	c.ConfigModTime = info.ModTime()
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(data, c)
+	default:
+		err = yaml.Unmarshal(data, c)
+	}
+	if err != nil {
+		return fmt.Errorf("解析配置文件 %s 失败: %w", path, err)
+	}
+	return nil
+}
+
+// validate 校验并规范化配置
+func (c *Config) validate() error {
+	u, err := url.Parse(c.UpstreamUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("无效的上游地址: %q", c.UpstreamUrl)
+	}
+	if c.DefaultKey == "" && c.KeysFile == "" {
+		return fmt.Errorf("default_key 与 keys_file 至少需要设置一个")
+	}
+	names := map[string]bool{}
+	for i := range c.UpstreamAccounts {
+		acc := &c.UpstreamAccounts[i]
+		if acc.Token == "" {
+			return fmt.Errorf("upstream_accounts[%d] 缺少 token", i)
+		}
+		if acc.Name == "" {
+			acc.Name = fmt.Sprintf("account-%d", i+1)
+		}
+		if names[acc.Name] {
+			return fmt.Errorf("upstream_accounts 中账号名称重复: %q", acc.Name)
+		}
+		names[acc.Name] = true
+		if acc.Weight < 0 {
+			return fmt.Errorf("upstream_accounts[%d] 权重不能为负数", i)
+		}
+		if acc.Weight == 0 {
+			acc.Weight = 1
+		}
+	}
+	if !c.AnonTokenEnabled && len(c.accounts()) == 0 {
+		return fmt.Errorf("关闭匿名token时必须设置 upstream_token 或 upstream_accounts")
+	}
+	if c.ModelName == "" {
+		c.ModelName = DefaultModelName
+	}
+	format, err := parseReasoningFormat(c.ReasoningFormat)
+	if err != nil {
+		return fmt.Errorf("无效的 reasoning_format: %q（可选 reasoning_content/inline/hidden）", c.ReasoningFormat)
+	}
+	c.ReasoningFormat = format
+	switch c.ThinkTagsMode {
+	case thinking.ModeThink, thinking.ModeStrip, thinking.ModeRaw:
+	default:
+		return fmt.Errorf("无效的 think_tags_mode: %q（可选 think/strip/raw）", c.ThinkTagsMode)
+	}
+	switch c.AnonTokenPolicy {
+	case TokenPolicySingle, TokenPolicyReuse, TokenPolicyUntilError:
+	default:
+		return fmt.Errorf("无效的 anon_token_policy: %q（可选 single/reuse/until-error）", c.AnonTokenPolicy)
+	}
+	if c.AnonPoolSize < 0 || c.AnonTokenMaxUses < 1 {
+		return fmt.Errorf("anon_pool_size 不能为负数，anon_token_max_uses 至少为1")
+	}
+	if c.UpstreamRetries < 0 || c.BreakerThreshold < 0 || c.StreamRecoveryAttempts < 0 {
+		return fmt.Errorf("upstream_retries、breaker_threshold 与 stream_recovery_attempts 不能为负数")
+	}
+	if c.StructuredOutputRetries < 0 {
+		return fmt.Errorf("structured_output_retries 不能为负数（0表示不修正）")
+	}
+	if c.MaxCompletionPrompts < 1 {
+		return fmt.Errorf("max_completion_prompts 至少为1")
+	}
+	if c.MaxImageBytes <= 0 || c.MaxRequestBytes <= 0 {
+		return fmt.Errorf("max_image_bytes 与 max_request_bytes 必须大于0")
+	}
+	if c.SessionTTL <= 0 || c.SessionMax < 0 {
+		return fmt.Errorf("session_ttl 必须大于0，session_max 不能为负数（0表示关闭会话）")
+	}
+	if c.ResponseStoreTTL <= 0 || c.ResponseStoreSize < 0 {
+		return fmt.Errorf("response_store_ttl 必须大于0，response_store_size 不能为负数（0表示不保存）")
+	}
+	if c.RetryBackoff <= 0 || c.RetryMaxBackoff < c.RetryBackoff {
+		return fmt.Errorf("retry_backoff 必须大于0且不大于 retry_max_backoff")
+	}
+	if c.UpstreamConnectTimeout < 0 || c.UpstreamFirstByteTimeout < 0 || c.UpstreamIdleTimeout < 0 || c.UpstreamTotalTimeout < 0 {
+		return fmt.Errorf("上游超时不能为负数（0表示不限制）")
+	}
+	if c.SSEHeartbeatInterval < 0 {
+		return fmt.Errorf("sse_heartbeat_interval 不能为负数（0表示关闭）")
+	}
+	for model, d := range c.ModelTimeouts {
+		if d < 0 {
+			return fmt.Errorf("model_timeouts[%s] 不能为负数", model)
+		}
+	}
+	if c.RateLimitRPM < 0 || c.MaxConcurrentStreams < 0 {
+		return fmt.Errorf("rate_limit_rpm 与 max_concurrent_streams 不能为负数")
+	}
+	port := strings.TrimPrefix(c.Port, ":")
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return fmt.Errorf("无效的端口: %q", c.Port)
+	}
+	c.Port = ":" + port
+	return nil
+}
+
+// currentConfig 当前生效的配置快照，热加载时整体原子替换
+var currentConfig atomic.Pointer[Config]
+
+// getConfig 获取当前配置快照；请求应在开始时获取一次并在整个生命周期内使用
+func getConfig() *Config {
+	return currentConfig.Load()
+}
+
+// configPollInterval 配置文件变更检测间隔
+const configPollInterval = 2 * time.Second
+
+// watchConfig 监听SIGHUP信号与配置文件变更，触发热加载
+func watchConfig(args []string) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	// 记录已处理的修改时间，避免对同一份错误文件反复重试
+	lastMod := getConfig().ConfigModTime
+	for {
+		select {
+		case <-sighup:
+			reloadConfig(args, "SIGHUP")
+			if info, err := os.Stat(getConfig().ConfigFile); err == nil {
+				lastMod = info.ModTime()
+			}
+		case <-ticker.C:
+			path := getConfig().ConfigFile
+			if path == "" {
+				continue
+			}
+			info, err := os.Stat(path)
+			if err != nil || info.ModTime().Equal(lastMod) {
+				continue
+			}
+			lastMod = info.ModTime()
+			reloadConfig(args, "配置文件变更")
+		}
+	}
+}
+
+// reloadConfig 重新加载配置并原子替换；加载失败时保留旧配置
+func reloadConfig(args []string, reason string) {
+	old := getConfig()
+	next, err := loadConfig(args)
+	if err != nil {
+		log.Printf("配置热加载失败（%s），继续使用旧配置: %v", reason, err)
+		return
+	}
+	if next.Port != old.Port {
+		log.Printf("监听端口变更需重启生效，保持 %s", old.Port)
+		next.Port = old.Port
+	}
+	currentConfig.Store(next)
+
+	changes := diffConfig(old, next)
+	if len(changes) == 0 {
+		log.Printf("配置已重新加载（%s），无变化", reason)
+		return
+	}
+	log.Printf("配置已重新加载（%s），变更: %s", reason, strings.Join(changes, ", "))
+}
+
+// diffConfig 比较两份配置，返回 "键: 旧值 -> 新值" 列表，敏感字段脱敏
+func diffConfig(old, next *Config) []string {
+	var changes []string
+	ov := reflect.ValueOf(old).Elem()
+	nv := reflect.ValueOf(next).Elem()
+	t := ov.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "-" || name == "" {
+			continue
+		}
+		a, b := ov.Field(i).Interface(), nv.Field(i).Interface()
+		if reflect.DeepEqual(a, b) {
+			continue
+		}
+		if field.Tag.Get("secret") == "true" {
+			changes = append(changes, name+": (已更新)")
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("%s: %v -> %v", name, a, b))
+	}
+	return changes
+}
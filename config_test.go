@@ -0,0 +1,186 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clearConfigEnv 清空所有配置相关的环境变量（空值视为未设置）
+func clearConfigEnv(t *testing.T) {
+	t.Helper()
+	t.Setenv("CONFIG_FILE", "")
+	for _, f := range configFields {
+		t.Setenv(f.env, "")
+	}
+}
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// 优先级：命令行参数 > 环境变量 > 配置文件 > 默认值
+func TestLoadConfigPrecedence(t *testing.T) {
+	clearConfigEnv(t)
+	path := writeConfigFile(t, "config.yaml", `
+default_key: from-file
+port: 9001
+model_name: file-model
+think_tags_mode: raw
+rate_limit_rpm: 30
+upstream_retries: 7
+retry_backoff: 200ms
+`)
+	t.Setenv("PORT", "9002")
+	t.Setenv("MODEL_NAME", "env-model")
+	t.Setenv("UPSTREAM_RETRIES", "8")
+
+	c, err := loadConfig([]string{"-config", path, "-model-name", "flag-model", "-debug"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checks := []struct {
+		field string
+		got   any
+		want  any
+	}{
+		{"default_key（文件）", c.DefaultKey, "from-file"},
+		{"think_tags_mode（文件）", c.ThinkTagsMode, "raw"},
+		{"rate_limit_rpm（文件）", c.RateLimitRPM, 30},
+		{"retry_backoff（文件）", c.RetryBackoff.D(), 200 * time.Millisecond},
+		{"upstream_retries（环境变量覆盖文件）", c.UpstreamRetries, 8},
+		{"port（环境变量覆盖文件）", c.Port, ":9002"},
+		{"model_name（参数覆盖环境变量）", c.ModelName, "flag-model"},
+		{"debug（布尔参数无取值）", c.DebugMode, true},
+		{"anon_token_enabled（默认值）", c.AnonTokenEnabled, true},
+		{"breaker_threshold（默认值）", c.BreakerThreshold, 5},
+		{"max_completion_prompts（默认值）", c.MaxCompletionPrompts, 16},
+		{"config_file", c.ConfigFile, path},
+	}
+	for _, tt := range checks {
+		if tt.got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.field, tt.got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigJSONFile(t *testing.T) {
+	clearConfigEnv(t)
+	path := writeConfigFile(t, "config.json", `{"default_key":"k","think_tags_mode":"strip","upstream_accounts":[{"token":"t1"},{"name":"b","token":"t2","weight":3}]}`)
+	c, err := loadConfig([]string{"-config", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.DefaultKey != "k" || c.ThinkTagsMode != "strip" {
+		t.Errorf("config = %+v", c)
+	}
+	accs := c.UpstreamAccounts
+	if len(accs) != 2 || accs[0].Name != "account-1" || accs[0].Weight != 1 || accs[1].Name != "b" || accs[1].Weight != 3 {
+		t.Errorf("upstream_accounts = %+v", accs)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		want string // 错误信息应包含的内容
+	}{
+		{"缺少密钥", nil, nil, "default_key 与 keys_file"},
+		{"空的密钥", nil, []string{"-config", writeConfigFile(t, "empty.yaml", `default_key: ""`)}, "default_key"},
+		{"无效的布尔值", map[string]string{"ANON_TOKEN_ENABLED": "maybe"}, []string{"-default-key", "k"}, "环境变量 ANON_TOKEN_ENABLED"},
+		{"无效的参数", nil, []string{"-default-key", "k", "-rate-limit-rpm", "soon"}, "参数 -rate-limit-rpm"},
+		{"无效的上游地址", nil, []string{"-default-key", "k", "-upstream-url", "ftp://x"}, "无效的上游地址"},
+		{"无效的整数", map[string]string{"RATE_LIMIT_RPM": "many"}, []string{"-default-key", "k"}, "环境变量 RATE_LIMIT_RPM"},
+		{"负的限流", nil, []string{"-default-key", "k", "-rate-limit-rpm", "-1"}, "rate_limit_rpm"},
+		{"无效的复用策略", nil, []string{"-default-key", "k", "-anon-token-policy", "often"}, "anon_token_policy"},
+		{"退避上限小于首次退避", nil, []string{"-default-key", "k", "-retry-backoff", "10s", "-retry-max-backoff", "1s"}, "retry_backoff"},
+		{"无效的时长", nil, []string{"-default-key", "k", "-retry-backoff", "soon"}, "参数 -retry-backoff"},
+		{"无效的思考模式", nil, []string{"-default-key", "k", "-think-tags-mode", "loud"}, "think_tags_mode"},
+		{"关闭匿名token且没有账号", nil, []string{"-default-key", "k", "-anon-token=false"}, "关闭匿名token"},
+		{"prompt 上限为0", nil, []string{"-default-key", "k", "-max-completion-prompts", "0"}, "max_completion_prompts"},
+		{"无效的推理格式", nil, []string{"-default-key", "k", "-reasoning-format", "loud"}, "reasoning_format"},
+		{"无效的端口", nil, []string{"-default-key", "k", "-port", "70000"}, "端口"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearConfigEnv(t)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			_, err := loadConfig(tt.args)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// 热加载整体替换配置快照：已取得旧快照的请求不受影响，加载失败时保留旧配置
+func TestReloadConfigSnapshot(t *testing.T) {
+	clearConfigEnv(t)
+	path := writeConfigFile(t, "config.yaml", "default_key: k1\nport: 9001\nmodel_name: m1\n")
+	args := []string{"-config", path}
+	c, err := loadConfig(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := getConfig()
+	currentConfig.Store(c)
+	t.Cleanup(func() { currentConfig.Store(prev) })
+
+	snapshot := getConfig()
+	if err := os.WriteFile(path, []byte("default_key: k2\nport: 9002\nmodel_name: m2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reloadConfig(args, "test")
+	next := getConfig()
+	if snapshot.DefaultKey != "k1" || snapshot.ModelName != "m1" {
+		t.Errorf("旧快照被修改: %+v", snapshot)
+	}
+	if next == snapshot || next.DefaultKey != "k2" || next.ModelName != "m2" {
+		t.Errorf("新配置未生效: %+v", next)
+	}
+	if next.Port != ":9001" {
+		t.Errorf("端口变更需重启生效，port = %s", next.Port)
+	}
+
+	if err := os.WriteFile(path, []byte("default_key: k3\nthink_tags_mode: loud\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reloadConfig(args, "test")
+	if getConfig() != next {
+		t.Error("加载失败时应保留旧配置")
+	}
+}
+
+func TestDiffConfigRedactsSecrets(t *testing.T) {
+	old := defaultConfig()
+	next := defaultConfig()
+	old.DefaultKey, next.DefaultKey = "old-secret", "new-secret"
+	next.UpstreamToken = "token-secret"
+	next.ModelName = "m2"
+
+	changes := strings.Join(diffConfig(old, next), "\n")
+	for _, secret := range []string{"old-secret", "new-secret", "token-secret"} {
+		if strings.Contains(changes, secret) {
+			t.Errorf("变更中泄露了敏感值 %q:\n%s", secret, changes)
+		}
+	}
+	for _, want := range []string{"default_key: (已更新)", "upstream_token: (已更新)", "model_name: " + old.ModelName + " -> m2"} {
+		if !strings.Contains(changes, want) {
+			t.Errorf("变更中缺少 %q:\n%s", want, changes)
+		}
+	}
+	if d := diffConfig(old, old); len(d) != 0 {
+		t.Errorf("相同配置的变更 = %v", d)
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"z2api/thinking"
+)
+
+// Google Gemini 兼容接口：/v1beta/models/{model}:generateContent 与 :streamGenerateContent。
+// contents/parts/systemInstruction 转换为上游对话，思考内容输出为 thought: true 的 part；
+// 流式时 alt=sse 使用SSE，否则按 Gemini 的方式输出一个逐步写出的JSON数组
+
+// GeminiRequest generateContent 请求；system_instruction 等下划线写法同样接受
+type GeminiRequest struct {
+	Contents               []GeminiContent   `json:"contents"`
+	SystemInstruction      *GeminiContent    `json:"systemInstruction,omitempty"`
+	SystemInstructionSnake *GeminiContent    `json:"system_instruction,omitempty"`
+	GenerationConfig       *GeminiGenConfig  `json:"generationConfig,omitempty"`
+	GenerationConfigSnake  *GeminiGenConfig  `json:"generation_config,omitempty"`
+	Tools                  []json.RawMessage `json:"tools,omitempty"`
+}
+
+// GeminiContent 一轮对话内容
+type GeminiContent struct {
+	Role  string       `json:"role,omitempty"`  // user / model
+	Parts []GeminiPart `json:"parts,omitempty"` // 没有内容时省略（如只带 finishReason 的最后一个chunk）
+}
+
+// GeminiPart 内容片段
+type GeminiPart struct {
+	Text             string          `json:"text,omitempty"`
+	Thought          bool            `json:"thought,omitempty"`
+	InlineData       *GeminiBlob     `json:"inlineData,omitempty"`
+	InlineDataSnake  *GeminiBlob     `json:"inline_data,omitempty"`
+	FileData         *GeminiFileData `json:"fileData,omitempty"`
+	FileDataSnake    *GeminiFileData `json:"file_data,omitempty"`
+	FunctionCall     json.RawMessage `json:"functionCall,omitempty"`
+	FunctionResponse json.RawMessage `json:"functionResponse,omitempty"`
+}
+
+// GeminiBlob 内联数据（base64）；类型由内容检测，mimeType 不使用
+type GeminiBlob struct {
+	Data string `json:"data"`
+}
+
+// GeminiFileData 文件引用，只支持 http(s) 图片地址
+type GeminiFileData struct {
+	FileURI      string `json:"fileUri,omitempty"`
+	FileURISnake string `json:"file_uri,omitempty"`
+}
+
+// GeminiGenConfig 生成参数（只使用下列字段）
+type GeminiGenConfig struct {
+	MaxOutputTokens  int                   `json:"maxOutputTokens,omitempty"`
+	StopSequences    []string              `json:"stopSequences,omitempty"`
+	ResponseMimeType string                `json:"responseMimeType,omitempty"`
+	ThinkingConfig   *GeminiThinkingConfig `json:"thinkingConfig,omitempty"`
+}
+
+// GeminiThinkingConfig 思考设置：thinkingBudget 为0关闭思考，-1 为不限制；
+// 与 Gemini 一致，只有 includeThoughts 为 true 时才返回思考内容
+type GeminiThinkingConfig struct {
+	ThinkingBudget  *int `json:"thinkingBudget,omitempty"`
+	IncludeThoughts bool `json:"includeThoughts,omitempty"`
+}
+
+// GeminiResponse generateContent 响应（流式时每个chunk一个）
+type GeminiResponse struct {
+	Candidates    []GeminiCandidate   `json:"candidates"`
+	UsageMetadata GeminiUsageMetadata `json:"usageMetadata"`
+	ModelVersion  string              `json:"modelVersion"`
+	ResponseID    string              `json:"responseId"`
+}
+
+// GeminiCandidate 候选回答
+type GeminiCandidate struct {
+	Content      GeminiContent `json:"content"`
+	FinishReason string        `json:"finishReason,omitempty"` // STOP / MAX_TOKENS
+	Index        int           `json:"index"`
+}
+
+// GeminiUsageMetadata 用量（上游不返回，固定为0）
+type GeminiUsageMetadata struct {
+	PromptTokenCount     int `json:"promptTokenCount"`
+	CandidatesTokenCount int `json:"candidatesTokenCount"`
+	TotalTokenCount      int `json:"totalTokenCount"`
+}
+
+func writeGeminiError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(geminiError(status, message))
+}
+
+// geminiErrors 供鉴权与限流中间件使用的 Gemini 格式错误
+func geminiErrors(w http.ResponseWriter, status int, _, _ string, message string) {
+	writeGeminiError(w, status, message)
+}
+
+func geminiError(status int, message string) map[string]any {
+	code := "INTERNAL"
+	switch status {
+	case http.StatusBadRequest:
+		code = "INVALID_ARGUMENT"
+	case http.StatusUnauthorized:
+		code = "UNAUTHENTICATED"
+	case http.StatusForbidden:
+		code = "PERMISSION_DENIED"
+	case http.StatusNotFound:
+		code = "NOT_FOUND"
+	case http.StatusTooManyRequests:
+		code = "RESOURCE_EXHAUSTED"
+	case http.StatusServiceUnavailable:
+		code = "UNAVAILABLE"
+	case http.StatusGatewayTimeout:
+		code = "DEADLINE_EXCEEDED"
+	}
+	return map[string]any{"error": map[string]any{"code": status, "message": message, "status": code}}
+}
+
+// toMessages 把 systemInstruction 与 contents 转换为消息；历史中的思考片段忽略
+func (req *GeminiRequest) toMessages() ([]Message, error) {
+	var msgs []Message
+	system := req.SystemInstruction
+	if system == nil {
+		system = req.SystemInstructionSnake
+	}
+	if system != nil {
+		text, _, err := geminiParts(system.Parts)
+		if err != nil {
+			return nil, fmt.Errorf("systemInstruction: %v", err)
+		}
+		if text != "" {
+			msgs = append(msgs, Message{Role: "system", Content: text})
+		}
+	}
+	for i, c := range req.Contents {
+		role := "user"
+		switch c.Role {
+		case "", "user":
+		case "model":
+			role = "assistant"
+		default:
+			return nil, fmt.Errorf("contents[%d]: unsupported role %q", i, c.Role)
+		}
+		text, images, err := geminiParts(c.Parts)
+		if err != nil {
+			return nil, fmt.Errorf("contents[%d]: %v", i, err)
+		}
+		msgs = append(msgs, Message{Role: role, Content: text, Parts: images})
+	}
+	return msgs, nil
+}
+
+func geminiParts(parts []GeminiPart) (string, []ContentPart, error) {
+	var texts []string
+	var images []ContentPart
+	for _, p := range parts {
+		switch {
+		case len(p.FunctionCall) > 0 || len(p.FunctionResponse) > 0:
+			return "", nil, fmt.Errorf("function calling is not supported")
+		case p.Thought:
+			continue
+		case p.InlineData != nil || p.InlineDataSnake != nil:
+			blob := p.InlineData
+			if blob == nil {
+				blob = p.InlineDataSnake
+			}
+			images = append(images, ContentPart{Type: "image_url", ImageURL: &ImageURL{URL: blob.Data}})
+		case p.FileData != nil || p.FileDataSnake != nil:
+			file := p.FileData
+			if file == nil {
+				file = p.FileDataSnake
+			}
+			uri := file.FileURI
+			if uri == "" {
+				uri = file.FileURISnake
+			}
+			if !strings.HasPrefix(uri, "http://") && !strings.HasPrefix(uri, "https://") {
+				return "", nil, fmt.Errorf("fileData: only http(s) image URLs are supported")
+			}
+			images = append(images, ContentPart{Type: "image_url", ImageURL: &ImageURL{URL: uri}})
+		default:
+			texts = append(texts, p.Text)
+		}
+	}
+	return strings.Join(texts, "\n"), images, nil
+}
+
+// handleGemini 分发 /v1beta/models 下的请求：GET 为模型列表或单个模型，POST 为生成
+func handleGemini(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v1beta/models"), "/")
+	if r.Method == "GET" {
+		handleGeminiModels(w, r, name)
+		return
+	}
+	i := strings.LastIndex(name, ":")
+	if r.Method != "POST" || i < 0 {
+		writeGeminiError(w, http.StatusNotFound, "unknown method "+r.URL.Path)
+		return
+	}
+	model, action := name[:i], name[i+1:]
+	switch action {
+	case "generateContent":
+		withRateLimit(geminiErrors, func(w http.ResponseWriter, r *http.Request) { handleGeminiGenerate(w, r, model, false) })(w, r)
+	case "streamGenerateContent":
+		withRateLimit(geminiErrors, func(w http.ResponseWriter, r *http.Request) { handleGeminiGenerate(w, r, model, true) })(w, r)
+	default:
+		writeGeminiError(w, http.StatusNotFound, fmt.Sprintf("method %q is not supported", action))
+	}
+}
+
+func handleGeminiModels(w http.ResponseWriter, r *http.Request, name string) {
+	cfg := configFromContext(r.Context())
+	apiKey := apiKeyFromContext(r.Context())
+
+	type geminiModel struct {
+		Name                       string   `json:"name"`
+		DisplayName                string   `json:"displayName"`
+		SupportedGenerationMethods []string `json:"supportedGenerationMethods"`
+		Thinking                   bool     `json:"thinking"`
+	}
+	var models []geminiModel
+	for _, m := range availableModels(cfg, apiKey) {
+		models = append(models, geminiModel{
+			Name:                       "models/" + m.ID,
+			DisplayName:                m.ID,
+			SupportedGenerationMethods: []string{"generateContent", "streamGenerateContent"},
+			Thinking:                   true,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if name == "" {
+		json.NewEncoder(w).Encode(map[string]any{"models": models})
+		return
+	}
+	for _, m := range models {
+		if m.Name == "models/"+name {
+			json.NewEncoder(w).Encode(m)
+			return
+		}
+	}
+	writeGeminiError(w, http.StatusNotFound, fmt.Sprintf("model %q not found", name))
+}
+
+func handleGeminiGenerate(w http.ResponseWriter, r *http.Request, model string, stream bool) {
+	debugLog("收到Gemini请求 - 模型: %s, 流式: %v", model, stream)
+	metrics.Requests.Add(1)
+
+	cfg := configFromContext(r.Context())
+	apiKey := apiKeyFromContext(r.Context())
+
+	var req GeminiRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		debugLog("JSON解析失败: %v", err)
+		writeGeminiError(w, http.StatusBadRequest, "Invalid JSON payload: "+err.Error())
+		return
+	}
+	if !apiKey.allowsModel(model) {
+		debugLog("密钥 %s 无权访问模型: %s", apiKey.ID, model)
+		writeGeminiError(w, http.StatusForbidden, "Model not allowed for this API key")
+		return
+	}
+	if len(req.Contents) == 0 {
+		writeGeminiError(w, http.StatusBadRequest, "contents is not specified")
+		return
+	}
+	if len(req.Tools) > 0 {
+		writeGeminiError(w, http.StatusBadRequest, "tools are not supported on this endpoint, use /v1/chat/completions")
+		return
+	}
+	gen := req.GenerationConfig
+	if gen == nil {
+		gen = req.GenerationConfigSnake
+	}
+	if gen == nil {
+		gen = &GeminiGenConfig{}
+	}
+	if gen.ResponseMimeType != "" && gen.ResponseMimeType != "text/plain" {
+		writeGeminiError(w, http.StatusBadRequest, fmt.Sprintf("responseMimeType %q is not supported, use response_format on /v1/chat/completions", gen.ResponseMimeType))
+		return
+	}
+
+	messages, err := req.toMessages()
+	if err != nil {
+		writeGeminiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	isThinking, isSearch := modelFeatures(model)
+	includeThoughts, thinkingBudget := false, 0
+	if tc := gen.ThinkingConfig; tc != nil {
+		includeThoughts = tc.IncludeThoughts
+		if b := tc.ThinkingBudget; b != nil {
+			isThinking = *b != 0
+			thinkingBudget = max(*b, 0)
+		}
+	}
+	images, err := prepareImages(r.Context(), cfg, messages)
+	if err != nil {
+		writeGeminiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	upstreamReq := newUpstreamRequest(cfg, messages, images, isThinking, isSearch)
+	if gen.MaxOutputTokens > 0 {
+		upstreamReq.Params["max_tokens"] = gen.MaxOutputTokens
+	}
+	if len(gen.StopSequences) > 0 {
+		upstreamReq.Params["stop"] = gen.StopSequences
+	}
+	limits := &turnLimits{
+		thinkingBudget: newTokenBudget(thinkingBudget),
+		contentBudget:  newTokenBudget(gen.MaxOutputTokens),
+		stop:           newStopMatcher(gen.StopSequences),
+	}
+	debugLog("思考: %v, 返回思考: %v, 思考预算: %d, maxOutputTokens: %d", isThinking, includeThoughts, thinkingBudget, gen.MaxOutputTokens)
+
+	ctx, cancel := withUpstreamDeadlines(r.Context(), resolveDeadlines(cfg, model, r.Header))
+	defer cancel()
+
+	out := &geminiOutput{w: w, cfg: cfg, stream: stream, sse: r.URL.Query().Get("alt") == "sse", base: GeminiResponse{
+		ModelVersion: model,
+		ResponseID:   newItemID(),
+	}}
+	if stream {
+		if _, ok := w.(http.Flusher); !ok {
+			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+	}
+	defer out.close()
+
+	err = runUpstream(ctx, cfg, upstreamReq, newAuthChain(cfg), thinking.ModeStrip, func(isReasoning bool, s string) bool {
+		kind, text, more := limits.accept(isReasoning, s)
+		if kind == "thinking" && !includeThoughts {
+			return more
+		}
+		out.delta(GeminiPart{Text: text, Thought: kind == "thinking"})
+		return more
+	})
+	if err != nil {
+		out.fail(ctx, err)
+		return
+	}
+	out.delta(GeminiPart{Text: limits.finish()})
+
+	reason := "STOP"
+	if limits.contentBudget.exhausted() {
+		reason = "MAX_TOKENS"
+	}
+	out.finish(reason)
+	metrics.Completed.Add(1)
+	debugLog("Gemini响应完成 (finishReason=%s)", reason)
+}
+
+// geminiOutput 输出 Gemini 响应：非流式时合并相邻的同类 part 后一次返回；
+// 流式时每个增量一个chunk，最后一个增量留到带 finishReason 的结束chunk中发送；
+// 第一个chunk在收到首个增量时才发送，上游在输出前失败时仍返回HTTP错误
+type geminiOutput struct {
+	w      http.ResponseWriter
+	cfg    *Config
+	stream bool
+	sse    bool // alt=sse；否则为JSON数组
+	base   GeminiResponse
+
+	out     *sseWriter // alt=sse 时使用
+	started bool
+	parts   []GeminiPart // 非流式时收集的 part
+	pending *GeminiPart  // 流式时尚未发送的最后一个增量
+}
+
+func (o *geminiOutput) chunk(parts []GeminiPart, finishReason string) GeminiResponse {
+	resp := o.base
+	resp.Candidates = []GeminiCandidate{{Content: GeminiContent{Role: "model", Parts: parts}, FinishReason: finishReason}}
+	return resp
+}
+
+func (o *geminiOutput) delta(p GeminiPart) {
+	if p.Text == "" {
+		return
+	}
+	if !o.stream {
+		if n := len(o.parts); n > 0 && o.parts[n-1].Thought == p.Thought {
+			o.parts[n-1].Text += p.Text
+		} else {
+			o.parts = append(o.parts, p)
+		}
+		return
+	}
+	o.flush()
+	o.pending = &p
+}
+
+// flush 发送暂存的增量
+func (o *geminiOutput) flush() {
+	if o.pending != nil {
+		o.write(o.chunk([]GeminiPart{*o.pending}, ""))
+		o.pending = nil
+	}
+}
+
+// write 流式发送一个chunk
+func (o *geminiOutput) write(v any) {
+	data, _ := json.Marshal(v)
+	if o.sse {
+		if o.out == nil {
+			o.w.Header().Set("Content-Type", "text/event-stream")
+			o.w.Header().Set("Cache-Control", "no-cache")
+			o.w.Header().Set("Connection", "keep-alive")
+			o.out = newSSEWriter(o.w, o.w.(http.Flusher), o.cfg.SSEHeartbeatInterval.D())
+		}
+		o.started = true
+		o.out.Data(data)
+		return
+	}
+	sep := ",\r\n"
+	if !o.started {
+		o.started = true
+		o.w.Header().Set("Content-Type", "application/json")
+		sep = "["
+	}
+	o.w.Write([]byte(sep))
+	o.w.Write(data)
+	o.w.(http.Flusher).Flush()
+}
+
+func (o *geminiOutput) finish(reason string) {
+	if !o.stream {
+		o.w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(o.w).Encode(o.chunk(o.parts, reason))
+		return
+	}
+	// 最后一段增量与 finishReason 一起发送；没有暂存的增量时该chunk不含 parts
+	var last []GeminiPart
+	if o.pending != nil {
+		last, o.pending = []GeminiPart{*o.pending}, nil
+	}
+	o.write(o.chunk(last, reason))
+}
+
+// fail 上游失败：尚未输出时返回HTTP错误，否则以一个错误对象结束流
+func (o *geminiOutput) fail(ctx context.Context, err error) {
+	f, ok := describeUpstreamFailure(ctx, o.w, o.cfg, err)
+	if !ok {
+		return
+	}
+	if !o.started {
+		writeGeminiError(o.w, f.Status, f.Message)
+		return
+	}
+	o.flush()
+	o.write(geminiError(f.Status, f.Message))
+}
+
+// close JSON数组模式下补上结尾的 ]
+func (o *geminiOutput) close() {
+	if o.out != nil {
+		o.out.Close()
+	}
+	if o.stream && !o.sse && o.started {
+		o.w.Write([]byte("]"))
+	}
+}
@@ -3,3 +3,5 @@ module z2api
 go 1.23.0
 
 toolchain go1.23.4
+
+require gopkg.in/yaml.v3 v3.0.1
@@ -0,0 +1,435 @@
+// Package jsonschema 实现结构化输出校验所需的 JSON Schema 子集
+//
+// 支持的关键字：type、enum、const、properties、required、additionalProperties、
+// minProperties/maxProperties、items/prefixItems、minItems/maxItems、uniqueItems、
+// minLength/maxLength、pattern、minimum/maximum、exclusiveMinimum/exclusiveMaximum、
+// multipleOf、allOf/anyOf/oneOf/not、nullable，以及指向文档内部的 $ref（#/$defs/...）。
+// format 等注解类关键字被忽略。
+package jsonschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Schema 已编译的 schema
+type Schema struct {
+	root     any
+	patterns map[string]*regexp.Regexp
+}
+
+// ValidationError 实例不符合 schema，Path 为 JSONPath 风格的位置
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// Compile 解析 schema，并预编译其中的正则表达式
+func Compile(raw []byte) (*Schema, error) {
+	root, err := decode(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	s := &Schema{root: root, patterns: map[string]*regexp.Regexp{}}
+	if err := s.compilePatterns(root); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ValidateJSON 解析并校验一个JSON文档
+func (s *Schema) ValidateJSON(data []byte) error {
+	v, err := decode(data)
+	if err != nil {
+		return err
+	}
+	return s.Validate(v)
+}
+
+// Validate 校验已解析的值（数字需为 json.Number）
+func (s *Schema) Validate(v any) error {
+	return s.validate(s.root, v, "$", 0)
+}
+
+// decode 解析JSON，数字保留为 json.Number，并拒绝尾随内容
+func decode(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("unexpected data after top-level value")
+	}
+	return v, nil
+}
+
+func (s *Schema) compilePatterns(node any) error {
+	switch n := node.(type) {
+	case map[string]any:
+		if p, ok := n["pattern"].(string); ok {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", p, err)
+			}
+			s.patterns[p] = re
+		}
+		for _, child := range n {
+			if err := s.compilePatterns(child); err != nil {
+				return err
+			}
+		}
+	case []any:
+		for _, child := range n {
+			if err := s.compilePatterns(child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// maxDepth 防止 $ref 循环引用导致无限递归
+const maxDepth = 64
+
+func (s *Schema) validate(node any, v any, path string, depth int) error {
+	if depth > maxDepth {
+		return &ValidationError{path, "schema nesting too deep (recursive $ref?)"}
+	}
+	switch n := node.(type) {
+	case bool:
+		if !n {
+			return &ValidationError{path, "no value is allowed here"}
+		}
+		return nil
+	case map[string]any:
+		return s.validateObject(n, v, path, depth)
+	}
+	return nil
+}
+
+func (s *Schema) validateObject(n map[string]any, v any, path string, depth int) error {
+	fail := func(format string, args ...any) error {
+		return &ValidationError{path, fmt.Sprintf(format, args...)}
+	}
+
+	if ref, ok := n["$ref"].(string); ok {
+		target, err := s.resolve(ref)
+		if err != nil {
+			return fail("%v", err)
+		}
+		if err := s.validate(target, v, path, depth+1); err != nil {
+			return err
+		}
+	}
+
+	if nullable, _ := n["nullable"].(bool); nullable && v == nil {
+		return nil
+	}
+	if t, ok := n["type"]; ok {
+		if err := checkType(t, v); err != nil {
+			return fail("%v", err)
+		}
+	}
+	if enum, ok := n["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			if equal(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fail("value %s is not one of %s", compact(v), compact(enum))
+		}
+	}
+	if c, ok := n["const"]; ok && !equal(c, v) {
+		return fail("value must be %s", compact(c))
+	}
+
+	for _, key := range []string{"allOf", "anyOf", "oneOf"} {
+		subs, ok := n[key].([]any)
+		if !ok {
+			continue
+		}
+		matched := 0
+		var firstErr error
+		for _, sub := range subs {
+			if err := s.validate(sub, v, path, depth+1); err != nil {
+				if key == "allOf" {
+					return err
+				}
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			matched++
+		}
+		switch {
+		case key == "anyOf" && matched == 0:
+			return fail("value does not match any schema in anyOf (first error: %v)", firstErr)
+		case key == "oneOf" && matched != 1:
+			return fail("value must match exactly one schema in oneOf, matched %d", matched)
+		}
+	}
+	if not, ok := n["not"]; ok {
+		if s.validate(not, v, path, depth+1) == nil {
+			return fail("value must not match the schema in not")
+		}
+	}
+
+	switch val := v.(type) {
+	case map[string]any:
+		return s.validateProperties(n, val, path, depth)
+	case []any:
+		return s.validateItems(n, val, path, depth)
+	case string:
+		length := utf8.RuneCountInString(val)
+		if min, ok := number(n["minLength"]); ok && float64(length) < min {
+			return fail("string is shorter than %v characters", min)
+		}
+		if max, ok := number(n["maxLength"]); ok && float64(length) > max {
+			return fail("string is longer than %v characters", max)
+		}
+		if p, ok := n["pattern"].(string); ok && !s.patterns[p].MatchString(val) {
+			return fail("string does not match pattern %q", p)
+		}
+	case json.Number:
+		f, _ := val.Float64()
+		if min, ok := number(n["minimum"]); ok && f < min {
+			return fail("%v is less than minimum %v", val, min)
+		}
+		if max, ok := number(n["maximum"]); ok && f > max {
+			return fail("%v is greater than maximum %v", val, max)
+		}
+		if min, ok := number(n["exclusiveMinimum"]); ok && f <= min {
+			return fail("%v must be greater than %v", val, min)
+		}
+		if max, ok := number(n["exclusiveMaximum"]); ok && f >= max {
+			return fail("%v must be less than %v", val, max)
+		}
+		if m, ok := number(n["multipleOf"]); ok && m > 0 {
+			if q := f / m; math.Abs(q-math.Round(q)) > 1e-9 {
+				return fail("%v is not a multiple of %v", val, m)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Schema) validateProperties(n map[string]any, obj map[string]any, path string, depth int) error {
+	if required, ok := n["required"].([]any); ok {
+		for _, r := range required {
+			if name, ok := r.(string); ok {
+				if _, present := obj[name]; !present {
+					return &ValidationError{path, fmt.Sprintf("missing required property %q", name)}
+				}
+			}
+		}
+	}
+	if min, ok := number(n["minProperties"]); ok && float64(len(obj)) < min {
+		return &ValidationError{path, fmt.Sprintf("object has fewer than %v properties", min)}
+	}
+	if max, ok := number(n["maxProperties"]); ok && float64(len(obj)) > max {
+		return &ValidationError{path, fmt.Sprintf("object has more than %v properties", max)}
+	}
+	props, _ := n["properties"].(map[string]any)
+	additional, hasAdditional := n["additionalProperties"]
+	// 按键排序，保证错误信息稳定
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		child := path + "." + k
+		if sub, ok := props[k]; ok {
+			if err := s.validate(sub, obj[k], child, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+		if !hasAdditional {
+			continue
+		}
+		if allowed, ok := additional.(bool); ok && !allowed {
+			return &ValidationError{path, fmt.Sprintf("additional property %q is not allowed", k)}
+		}
+		if err := s.validate(additional, obj[k], child, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Schema) validateItems(n map[string]any, arr []any, path string, depth int) error {
+	if min, ok := number(n["minItems"]); ok && float64(len(arr)) < min {
+		return &ValidationError{path, fmt.Sprintf("array has fewer than %v items", min)}
+	}
+	if max, ok := number(n["maxItems"]); ok && float64(len(arr)) > max {
+		return &ValidationError{path, fmt.Sprintf("array has more than %v items", max)}
+	}
+	if unique, _ := n["uniqueItems"].(bool); unique {
+		for i := range arr {
+			for j := i + 1; j < len(arr); j++ {
+				if equal(arr[i], arr[j]) {
+					return &ValidationError{path, fmt.Sprintf("items %d and %d are equal", i, j)}
+				}
+			}
+		}
+	}
+	prefix, _ := n["prefixItems"].([]any)
+	items, hasItems := n["items"]
+	if tuple, ok := items.([]any); ok {
+		// draft-07 的数组形式 items 等同于 prefixItems
+		prefix, hasItems = tuple, false
+		if extra, ok := n["additionalItems"]; ok {
+			items, hasItems = extra, true
+		}
+	}
+	for i, item := range arr {
+		child := path + "[" + strconv.Itoa(i) + "]"
+		var sub any
+		switch {
+		case i < len(prefix):
+			sub = prefix[i]
+		case hasItems:
+			sub = items
+		default:
+			continue
+		}
+		if err := s.validate(sub, item, child, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve 解析文档内部的 $ref（JSON Pointer）
+func (s *Schema) resolve(ref string) (any, error) {
+	if ref == "#" {
+		return s.root, nil
+	}
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("unsupported $ref %q (only local references are supported)", ref)
+	}
+	node := s.root
+	for _, part := range strings.Split(ref[2:], "/") {
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+		m, ok := node.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+		if node, ok = m[part]; !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+	}
+	return node, nil
+}
+
+func checkType(t any, v any) error {
+	var types []string
+	switch tt := t.(type) {
+	case string:
+		types = []string{tt}
+	case []any:
+		for _, x := range tt {
+			if s, ok := x.(string); ok {
+				types = append(types, s)
+			}
+		}
+	}
+	actual := typeOf(v)
+	for _, want := range types {
+		if want == actual || (want == "number" && actual == "integer") {
+			return nil
+		}
+	}
+	return fmt.Errorf("expected %s, got %s", strings.Join(types, " or "), actual)
+}
+
+func typeOf(v any) string {
+	switch val := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	case json.Number:
+		if f, err := val.Float64(); err == nil && f == math.Trunc(f) && !math.IsInf(f, 0) {
+			return "integer"
+		}
+		return "number"
+	}
+	return "unknown"
+}
+
+func number(v any) (float64, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := n.Float64()
+	return f, err == nil
+}
+
+// equal 比较两个JSON值，数字按数值比较
+func equal(a, b any) bool {
+	switch x := a.(type) {
+	case json.Number:
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		fx, _ := x.Float64()
+		fy, _ := y.Float64()
+		return fx == fy
+	case []any:
+		y, ok := b.([]any)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !equal(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]any:
+		y, ok := b.(map[string]any)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, xv := range x {
+			yv, ok := y[k]
+			if !ok || !equal(xv, yv) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+func compact(v any) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
@@ -0,0 +1,71 @@
+package jsonschema
+
+import (
+	"strings"
+	"testing"
+)
+
+const person = `{
+	"type": "object",
+	"properties": {
+		"name": {"type": "string", "minLength": 1},
+		"age": {"type": "integer", "minimum": 0},
+		"tags": {"type": "array", "items": {"$ref": "#/$defs/tag"}, "uniqueItems": true},
+		"role": {"enum": ["admin", "user"]}
+	},
+	"required": ["name", "age"],
+	"additionalProperties": false,
+	"$defs": {"tag": {"type": "string", "pattern": "^[a-z]+$"}}
+}`
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		schema string
+		doc    string
+		err    string // 期望错误包含的内容，空表示应通过
+	}{
+		{person, `{"name":"a","age":3,"tags":["x","y"],"role":"user"}`, ""},
+		{person, `{"name":"a","age":3.0}`, ""},
+		{person, `{"name":"a"}`, `$: missing required property "age"`},
+		{person, `{"name":"a","age":1.5}`, "$.age: expected integer, got number"},
+		{person, `{"name":"","age":1}`, "$.name: string is shorter"},
+		{person, `{"name":"a","age":-1}`, "$.age: -1 is less than minimum"},
+		{person, `{"name":"a","age":1,"x":1}`, `additional property "x"`},
+		{person, `{"name":"a","age":1,"tags":["x","X"]}`, "$.tags[1]: string does not match pattern"},
+		{person, `{"name":"a","age":1,"tags":["x","x"]}`, "items 0 and 1 are equal"},
+		{person, `{"name":"a","age":1,"role":"root"}`, "$.role: value \"root\" is not one of"},
+		{person, `[]`, "$: expected object, got array"},
+		{person, `{"name":"a","age":1} {}`, "unexpected data"},
+		{`{"type":["string","null"]}`, `null`, ""},
+		{`{"anyOf":[{"type":"string"},{"type":"number"}]}`, `true`, "does not match any schema in anyOf"},
+		{`{"oneOf":[{"type":"number"},{"type":"integer"}]}`, `1`, "matched 2"},
+		{`{"type":"number","multipleOf":0.5}`, `1.5`, ""},
+		{`{"type":"number","exclusiveMaximum":1}`, `1`, "must be less than 1"},
+		{`{"prefixItems":[{"type":"string"}],"items":false}`, `["a",1]`, "$[1]: no value is allowed"},
+		{`{"const":{"a":[1,2]}}`, `{"a":[1.0,2]}`, ""},
+		{`{"type":"object","properties":{"next":{"$ref":"#"}}}`, `{"next":{"next":{}}}`, ""},
+		{`{"$ref":"#/$defs/missing"}`, `1`, "unresolvable $ref"},
+		{`true`, `{"anything":1}`, ""},
+	}
+	for _, tt := range tests {
+		s, err := Compile([]byte(tt.schema))
+		if err != nil {
+			t.Fatalf("Compile(%s): %v", tt.schema, err)
+		}
+		err = s.ValidateJSON([]byte(tt.doc))
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", tt.doc, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: got error %v, want %q", tt.doc, err, tt.err)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, schema := range []string{`{`, `{"pattern":"("}`} {
+		if _, err := Compile([]byte(schema)); err == nil {
+			t.Errorf("Compile(%s): expected error", schema)
+		}
+	}
+}
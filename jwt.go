@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// jwtClaims 上游token中关心的声明（仅解码，不校验签名）
+type jwtClaims struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+	Exp   int64  `json:"exp"`
+	Iat   int64  `json:"iat"`
+}
+
+// decodeJWTClaims 解码JWT载荷
+func decodeJWTClaims(token string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, fmt.Errorf("decode JWT payload: %w", err)
+	}
+	var c jwtClaims
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return nil, fmt.Errorf("parse JWT claims: %w", err)
+	}
+	return &c, nil
+}
+
+// tokenExpiry 返回token过期时间；无法解析或没有exp声明时返回零值
+func tokenExpiry(token string) time.Time {
+	c, err := decodeJWTClaims(token)
+	if err != nil || c.Exp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(c.Exp, 0)
+}
+
+// expiresWithin 判断过期时间是否落在 margin 内（零值表示永不过期）
+func expiresWithin(exp time.Time, margin time.Duration) bool {
+	return !exp.IsZero() && time.Until(exp) < margin
+}
+
+// TokenInfo token身份与剩余有效期（用于管理接口，token本身已脱敏）
+type TokenInfo struct {
+	Source    string     `json:"source"`
+	Token     string     `json:"token"`
+	ID        string     `json:"id,omitempty"`
+	Email     string     `json:"email,omitempty"`
+	IssuedAt  *time.Time `json:"issued_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Remaining string     `json:"remaining,omitempty"`
+	Expired   bool       `json:"expired"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// inspectToken 解码token并生成脱敏后的描述
+func inspectToken(source, token string) TokenInfo {
+	info := TokenInfo{Source: source, Token: maskKey(token)}
+	c, err := decodeJWTClaims(token)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	info.ID, info.Email = c.ID, c.Email
+	if c.Iat > 0 {
+		iat := time.Unix(c.Iat, 0).UTC()
+		info.IssuedAt = &iat
+	}
+	if c.Exp > 0 {
+		exp := time.Unix(c.Exp, 0).UTC()
+		info.ExpiresAt = &exp
+		if left := time.Until(exp); left > 0 {
+			info.Remaining = left.Round(time.Second).String()
+		} else {
+			info.Expired = true
+		}
+	}
+	return info
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	errKeyNotFound = errors.New("invalid API key")
+	errKeyDisabled = errors.New("API key disabled")
+	errKeyExpired  = errors.New("API key expired")
+)
+
+// APIKey 客户端密钥及其元数据（只保存哈希，不保存明文）
+type APIKey struct {
+	ID              string     `json:"id"`
+	Hash            string     `json:"hash"`
+	Prefix          string     `json:"prefix"` // 明文前缀，仅用于展示与日志
+	Name            string     `json:"name"`
+	Owner           string     `json:"owner,omitempty"`
+	AllowedModels   []string   `json:"allowed_models,omitempty"`   // 为空表示不限制
+	RPM             int        `json:"rpm,omitempty"`              // 每分钟请求数，0表示使用全局默认
+	MaxConcurrent   int        `json:"max_concurrent,omitempty"`   // 最大并发流，0表示使用全局默认
+	ReasoningFormat string     `json:"reasoning_format,omitempty"` // 默认推理输出格式，为空使用全局默认
+	ExpiresAt       *time.Time `json:"expires_at,omitempty"`
+	Enabled         bool       `json:"enabled"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+// allowsModel 判断该密钥是否允许访问指定模型
+func (k *APIKey) allowsModel(model string) bool {
+	if len(k.AllowedModels) == 0 {
+		return true
+	}
+	for _, m := range k.AllowedModels {
+		if m == model || m == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// hashKey 计算密钥哈希（API密钥为高熵随机串，使用SHA-256即可）
+func hashKey(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// maskKey 返回脱敏后的密钥，用于日志
+func maskKey(raw string) string {
+	if len(raw) <= 8 {
+		return "***"
+	}
+	return raw[:6] + "..." + raw[len(raw)-2:]
+}
+
+// KeyStore 基于JSON文件的密钥存储，文件修改后自动重新加载
+type KeyStore struct {
+	mu      sync.RWMutex
+	path    string
+	modTime time.Time
+	keys    map[string]*APIKey // hash -> key
+}
+
+type keyStoreFile struct {
+	Keys []*APIKey `json:"keys"`
+}
+
+// openKeyStore 打开密钥文件，文件不存在时视为空存储
+func openKeyStore(path string) (*KeyStore, error) {
+	s := &KeyStore{path: path, keys: map[string]*APIKey{}}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *KeyStore) load() error {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.keys = map[string]*APIKey{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var f keyStoreFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("解析密钥文件 %s 失败: %w", s.path, err)
+	}
+	keys := make(map[string]*APIKey, len(f.Keys))
+	for _, k := range f.Keys {
+		keys[k.Hash] = k
+	}
+	s.keys = keys
+	s.modTime = info.ModTime()
+	return nil
+}
+
+// refresh 密钥文件有变化时重新加载
+func (s *KeyStore) refresh() {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return
+	}
+	s.mu.RLock()
+	changed := !info.ModTime().Equal(s.modTime)
+	s.mu.RUnlock()
+	if !changed {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		debugLog("重新加载密钥文件失败: %v", err)
+	}
+}
+
+// Lookup 校验明文密钥，返回其元数据
+func (s *KeyStore) Lookup(raw string) (*APIKey, error) {
+	s.refresh()
+	s.mu.RLock()
+	k, ok := s.keys[hashKey(raw)]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, errKeyNotFound
+	}
+	if !k.Enabled {
+		return k, errKeyDisabled
+	}
+	if k.ExpiresAt != nil && time.Now().After(*k.ExpiresAt) {
+		return k, errKeyExpired
+	}
+	return k, nil
+}
+
+// List 返回全部密钥（按创建时间排序）
+func (s *KeyStore) List() []*APIKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]*APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		list = append(list, k)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+// Create 生成新密钥并持久化，返回明文（仅此一次可见）
+func (s *KeyStore) Create(k APIKey) (string, *APIKey, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", nil, err
+	}
+	raw := "sk-" + hex.EncodeToString(buf)
+	k.Hash = hashKey(raw)
+	k.ID = k.Hash[:12]
+	k.Prefix = raw[:8]
+	k.Enabled = true
+	k.CreatedAt = time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[k.Hash] = &k
+	if err := s.save(); err != nil {
+		delete(s.keys, k.Hash)
+		return "", nil, err
+	}
+	return raw, &k, nil
+}
+
+// Update 按ID修改密钥元数据并持久化
+func (s *KeyStore) Update(id string, fn func(k *APIKey)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, k := range s.keys {
+		if k.ID == id {
+			// 复制后替换，避免与并发读取者共享可变对象
+			updated := *k
+			fn(&updated)
+			s.keys[hash] = &updated
+			if err := s.save(); err != nil {
+				s.keys[hash] = k
+				return err
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("密钥 %s 不存在", id)
+}
+
+// Delete 按ID删除密钥并持久化
+func (s *KeyStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, k := range s.keys {
+		if k.ID == id {
+			delete(s.keys, hash)
+			return s.save()
+		}
+	}
+	return fmt.Errorf("密钥 %s 不存在", id)
+}
+
+// save 写入临时文件后重命名，保证文件完整（调用方需持有写锁）
+func (s *KeyStore) save() error {
+	f := keyStoreFile{Keys: make([]*APIKey, 0, len(s.keys))}
+	for _, k := range s.keys {
+		f.Keys = append(f.Keys, k)
+	}
+	sort.Slice(f.Keys, func(i, j int) bool { return f.Keys[i].CreatedAt.Before(f.Keys[j].CreatedAt) })
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".keys-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+	return nil
+}
+
+var (
+	keyStoresMu sync.Mutex
+	keyStores   = map[string]*KeyStore{}
+)
+
+// getKeyStore 按路径获取（并缓存）密钥存储，配置热加载更换路径后自动切换
+func getKeyStore(path string) (*KeyStore, error) {
+	keyStoresMu.Lock()
+	defer keyStoresMu.Unlock()
+	if s, ok := keyStores[path]; ok {
+		return s, nil
+	}
+	s, err := openKeyStore(path)
+	if err != nil {
+		return nil, err
+	}
+	keyStores[path] = s
+	return s, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// upstreamFrame 构造一个上游SSE帧
+func upstreamFrame(phase, delta string, done bool) string {
+	b, _ := json.Marshal(map[string]any{"type": "chat:completion", "data": map[string]any{"phase": phase, "delta_content": delta, "done": done}})
+	return "data: " + string(b) + "\n\n"
+}
+
+// fakeUpstream 模拟上游：第 n 次请求（从0开始）由 attempt(n) 处理，返回请求总数
+func fakeUpstream(t *testing.T, attempt func(n int, w http.ResponseWriter, f http.Flusher)) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(calls.Add(1)) - 1
+		w.Header().Set("Content-Type", "text/event-stream")
+		attempt(n, w, w.(http.Flusher))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+// testChatConfig 使用 n 个上游账号（重放时换用下一个）、关闭熔断的配置
+func testChatConfig(upstreamURL string, n int) *Config {
+	cfg := defaultConfig()
+	cfg.UpstreamUrl = upstreamURL
+	for i := 1; i <= n; i++ {
+		cfg.UpstreamAccounts = append(cfg.UpstreamAccounts, UpstreamAccount{Name: fmt.Sprintf("test-%d", i), Token: fmt.Sprintf("t%d", i), Weight: 1})
+	}
+	cfg.AnonTokenEnabled = false
+	cfg.DefaultKey = "k"
+	cfg.BreakerThreshold = 0
+	cfg.RetryBackoff = Duration(time.Millisecond)
+	cfg.ThinkTagsMode = "strip"
+	return cfg
+}
+
+// streamChat 以流式请求调用 handleChatCompletions，返回各个 data 帧
+func streamChat(t *testing.T, cfg *Config) []string {
+	t.Helper()
+	ctx := context.WithValue(context.WithValue(context.Background(), ctxKeyConfig, cfg), ctxKeyAPIKey, &APIKey{ID: "test"})
+	body := `{"model":"GLM-4.5","stream":true,"messages":[{"role":"user","content":"hi"}]}`
+	rec := httptest.NewRecorder()
+	handleChatCompletions(rec, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)).WithContext(ctx))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+	}
+	var frames []string
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			frames = append(frames, data)
+		}
+	}
+	return frames
+}
+
+// streamContent 拼接各帧的 delta.content
+func streamContent(frames []string) string {
+	var sb strings.Builder
+	for _, f := range frames {
+		var chunk OpenAIResponse
+		if json.Unmarshal([]byte(f), &chunk) == nil && len(chunk.Choices) > 0 {
+			sb.WriteString(chunk.Choices[0].Delta.Content)
+		}
+	}
+	return sb.String()
+}
+
+// 输出任何内容前上游断开或返回错误帧时静默重放，客户端只看到一次完整回答
+func TestStreamReplayBeforeFirstContent(t *testing.T) {
+	srv, calls := fakeUpstream(t, func(n int, w http.ResponseWriter, f http.Flusher) {
+		switch n {
+		case 0:
+			// 没有任何数据就断开
+		case 1:
+			fmt.Fprint(w, `data: {"type":"chat:completion","data":{"error":{"detail":"busy","code":429}}}`+"\n\n")
+		default:
+			fmt.Fprint(w, upstreamFrame("answer", "Hello", false))
+			fmt.Fprint(w, upstreamFrame("answer", " world", false))
+			fmt.Fprint(w, upstreamFrame("done", "", true))
+		}
+	})
+	cfg := testChatConfig(srv.URL, 3)
+	cfg.StreamRecoveryAttempts = 2
+
+	frames := streamChat(t, cfg)
+	if got := streamContent(frames); got != "Hello world" {
+		t.Errorf("content = %q", got)
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("上游请求次数 = %d, want 3", n)
+	}
+	if roles := strings.Count(strings.Join(frames, "\n"), `"role":"assistant"`); roles != 1 {
+		t.Errorf("role chunk 出现 %d 次", roles)
+	}
+	if frames[len(frames)-1] != "[DONE]" {
+		t.Errorf("最后一帧 = %q", frames[len(frames)-1])
+	}
+}
+
+// 已输出内容后中断不再重放；重放次数用尽时结束流
+func TestStreamNoReplayAfterContent(t *testing.T) {
+	tests := []struct {
+		name     string
+		attempts int
+		first    string
+		calls    int32
+		content  string
+	}{
+		{"已输出内容", 2, upstreamFrame("answer", "Hel", false), 1, "Hel"},
+		{"未开启重放", 0, "", 1, ""},
+		{"重放次数用尽", 1, "", 2, ""},
+	}
+	for _, tt := range tests {
+		srv, calls := fakeUpstream(t, func(n int, w http.ResponseWriter, f http.Flusher) {
+			fmt.Fprint(w, tt.first)
+		})
+		cfg := testChatConfig(srv.URL, 3)
+		cfg.StreamRecoveryAttempts = tt.attempts
+		frames := streamChat(t, cfg)
+		if got := streamContent(frames); got != tt.content || calls.Load() != tt.calls {
+			t.Errorf("%s: content = %q, 上游请求 %d 次", tt.name, got, calls.Load())
+		}
+	}
+}
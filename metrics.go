@@ -0,0 +1,27 @@
+package main
+
+import "sync/atomic"
+
+// Metrics 请求计数（客户端取消与上游错误分开统计）
+type Metrics struct {
+	Requests            atomic.Int64
+	Completed           atomic.Int64
+	UpstreamErrors      atomic.Int64
+	UpstreamTimeouts    atomic.Int64 // 上游超时（同时计入 UpstreamErrors）
+	ClientCancellations atomic.Int64
+	StreamRecoveries    atomic.Int64
+}
+
+var metrics Metrics
+
+// Snapshot 返回计数快照
+func (m *Metrics) Snapshot() map[string]int64 {
+	return map[string]int64{
+		"requests":             m.Requests.Load(),
+		"completed":            m.Completed.Load(),
+		"upstream_errors":      m.UpstreamErrors.Load(),
+		"upstream_timeouts":    m.UpstreamTimeouts.Load(),
+		"client_cancellations": m.ClientCancellations.Load(),
+		"stream_recoveries":    m.StreamRecoveries.Load(),
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// 多模态消息：content 可以是字符串，也可以是 text / image_url 片段数组。
+// 文本片段拼接到 Message.Content，图片用每个凭证通过上游文件接口上传一次，再以文件ID引用。
+
+// ContentPart OpenAI 消息内容片段
+type ContentPart struct {
+	Type     string    `json:"type"` // text / image_url
+	Text     string    `json:"text,omitempty"`
+	ImageURL *ImageURL `json:"image_url,omitempty"`
+
+	image *imageInput // 已加载的图片数据
+}
+
+// ImageURL 图片地址：http(s) 链接、data URL 或纯 base64
+type ImageURL struct {
+	URL    string `json:"url"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// UnmarshalJSON 兼容字符串与片段数组两种 content
+func (m *Message) UnmarshalJSON(data []byte) error {
+	type plain Message
+	var raw struct {
+		plain
+		Content json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*m = Message(raw.plain)
+	m.Content, m.Parts = "", nil
+	content := bytes.TrimSpace(raw.Content)
+	if len(content) == 0 || string(content) == "null" {
+		return nil
+	}
+	if content[0] != '[' {
+		return json.Unmarshal(content, &m.Content)
+	}
+	var parts []ContentPart
+	if err := json.Unmarshal(content, &parts); err != nil {
+		return err
+	}
+	var texts []string
+	for _, p := range parts {
+		switch p.Type {
+		case "text", "input_text":
+			texts = append(texts, p.Text)
+		case "image_url":
+			if p.ImageURL == nil || p.ImageURL.URL == "" {
+				return fmt.Errorf("image_url content part without url")
+			}
+			m.Parts = append(m.Parts, p)
+		default:
+			return fmt.Errorf("unsupported content part type %q", p.Type)
+		}
+	}
+	m.Content = strings.Join(texts, "\n")
+	return nil
+}
+
+// MarshalJSON 含图片时以片段数组发送（文本在前、图片在后），否则仍为字符串
+// 文本以 Content 为准，注入的提示词等改写不会因为片段数组而丢失
+func (m Message) MarshalJSON() ([]byte, error) {
+	type plain Message
+	if len(m.Parts) == 0 {
+		return json.Marshal(plain(m))
+	}
+	parts := make([]ContentPart, 0, len(m.Parts)+1)
+	if m.Content != "" {
+		parts = append(parts, ContentPart{Type: "text", Text: m.Content})
+	}
+	parts = append(parts, m.Parts...)
+	return json.Marshal(struct {
+		plain
+		Content []ContentPart `json:"content"`
+	}{plain(m), parts})
+}
+
+// hasImages 请求中是否含有图片
+func hasImages(msgs []Message) bool {
+	for _, m := range msgs {
+		if len(m.Parts) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// errImagesDisabled 未配置视觉模型时拒绝图片输入
+var errImagesDisabled = errors.New("image inputs are disabled on this server")
+
+// prepareImages 请求含图片时加载全部图片；未配置视觉模型时返回 errImagesDisabled
+func prepareImages(ctx context.Context, cfg *Config, msgs []Message) ([]*imageInput, error) {
+	if !hasImages(msgs) {
+		return nil, nil
+	}
+	if cfg.VisionModel == "" {
+		return nil, errImagesDisabled
+	}
+	images, err := loadImages(ctx, cfg, msgs)
+	if err != nil {
+		return nil, err
+	}
+	debugLog("请求包含%d张图片，使用视觉模型: %s", len(images), cfg.VisionModel)
+	return images, nil
+}
+
+// imageErrorCode prepareImages 错误对应的错误码
+func imageErrorCode(err error) string {
+	if errors.Is(err, errImagesDisabled) {
+		return "images_not_supported"
+	}
+	return "invalid_image"
+}
+
+// imageInput 一张待上传的图片
+type imageInput struct {
+	data []byte
+	mime string
+	name string
+}
+
+// imageFetchTimeout 下载远程图片的超时
+const imageFetchTimeout = 30 * time.Second
+
+// loadImages 解码或下载所有图片片段，返回按出现顺序排列的图片；图片无效时返回错误（客户端错误）
+func loadImages(ctx context.Context, cfg *Config, msgs []Message) ([]*imageInput, error) {
+	var images []*imageInput
+	for i := range msgs {
+		for j := range msgs[i].Parts {
+			p := &msgs[i].Parts[j]
+			img, err := loadImage(ctx, cfg, p.ImageURL.URL)
+			if err != nil {
+				return nil, err
+			}
+			img.name = fmt.Sprintf("image-%d%s", len(images)+1, extensionFor(img.mime))
+			p.image = img
+			images = append(images, img)
+		}
+	}
+	return images, nil
+}
+
+func loadImage(ctx context.Context, cfg *Config, src string) (*imageInput, error) {
+	var data []byte
+	switch {
+	case strings.HasPrefix(src, "data:"):
+		meta, payload, ok := strings.Cut(src[len("data:"):], ",")
+		if !ok || !strings.HasSuffix(meta, ";base64") {
+			return nil, fmt.Errorf("invalid image data URL (expected data:<mime>;base64,...)")
+		}
+		b, err := decodeImageBase64(payload, cfg.MaxImageBytes)
+		if err != nil {
+			return nil, err
+		}
+		data = b
+	case strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://"):
+		b, err := fetchImage(ctx, src, cfg.MaxImageBytes)
+		if err != nil {
+			return nil, err
+		}
+		data = b
+	default:
+		b, err := decodeImageBase64(src, cfg.MaxImageBytes)
+		if errors.Is(err, errImageTooLarge) {
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unsupported image url: expected http(s) URL, data URL or base64")
+		}
+		data = b
+	}
+	if len(data) > cfg.MaxImageBytes {
+		return nil, fmt.Errorf("%w (%d bytes)", errImageTooLarge, cfg.MaxImageBytes)
+	}
+	mimeType := http.DetectContentType(data)
+	if !strings.HasPrefix(mimeType, "image/") {
+		return nil, fmt.Errorf("unsupported image content type %q", mimeType)
+	}
+	return &imageInput{data: data, mime: mimeType}, nil
+}
+
+// errImageTooLarge 图片超过 max_image_bytes
+var errImageTooLarge = errors.New("image exceeds max_image_bytes")
+
+// decodeImageBase64 解码base64图片；先按编码长度估算解码后的大小（含填充时最多多算2字节），超限时不再解码
+func decodeImageBase64(payload string, limit int) ([]byte, error) {
+	if base64.StdEncoding.DecodedLen(len(payload)) > limit+2 {
+		return nil, fmt.Errorf("%w (%d bytes)", errImageTooLarge, limit)
+	}
+	b, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 image data: %v", err)
+	}
+	return b, nil
+}
+
+// imageFetchMaxRedirects 下载远程图片时最多跟随的重定向次数
+const imageFetchMaxRedirects = 5
+
+// errForbiddenImageAddr 图片地址解析到内网、回环或链路本地地址
+var errForbiddenImageAddr = errors.New("image url resolves to a non-public address")
+
+// imageClient 下载客户端提供的图片链接：在DNS解析之后检查实际连接的IP，拒绝内网地址，
+// 每一跳重定向都会重新拨号，因而同样受到检查；不使用环境变量中的代理
+var imageClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip := net.ParseIP(host)
+				if ip == nil || !imageAddrAllowed(ip) {
+					return errForbiddenImageAddr
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: imageFetchTimeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= imageFetchMaxRedirects {
+			return fmt.Errorf("stopped after %d redirects", imageFetchMaxRedirects)
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("redirect to unsupported scheme %q", req.URL.Scheme)
+		}
+		return nil
+	},
+}
+
+// imageAddrAllowed 下载图片时允许连接的地址（测试中替换）
+var imageAddrAllowed = publicIP
+
+// publicIP 是否为可公开访问的单播地址（另排除 0.0.0.0/8 与运营商级NAT的 100.64.0.0/10）
+func publicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil && (ip4[0] == 0 || ip4[0] == 100 && ip4[1]&0xc0 == 64) {
+		return false
+	}
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+func fetchImage(ctx context.Context, src string, limit int) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, imageFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", src, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image url: %v", err)
+	}
+	req.Header.Set("User-Agent", BrowserUa)
+	resp, err := imageClient.Do(req)
+	if err != nil {
+		if errors.Is(err, errForbiddenImageAddr) {
+			return nil, fmt.Errorf("failed to fetch image: %v", errForbiddenImageAddr)
+		}
+		return nil, fmt.Errorf("failed to fetch image: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch image: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(limit)+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch image: %v", err)
+	}
+	return data, nil
+}
+
+func extensionFor(mimeType string) string {
+	if exts, _ := mime.ExtensionsByType(mimeType); len(exts) > 0 {
+		return exts[len(exts)-1]
+	}
+	return ""
+}
+
+// UpstreamFile 上游请求 files 字段中的文件引用
+type UpstreamFile struct {
+	Type   string          `json:"type"`
+	File   json.RawMessage `json:"file"` // 上传接口返回的文件对象
+	ID     string          `json:"id"`
+	URL    string          `json:"url"`
+	Name   string          `json:"name"`
+	Status string          `json:"status"`
+	Size   int             `json:"size"`
+	ItemID string          `json:"itemId"`
+	Media  string          `json:"media"`
+}
+
+// uploadImages 用当前凭证上传图片（上游文件归属于账号，换凭证后需重新上传），
+// 返回引用文件ID的消息副本与 files 字段
+func uploadImages(ctx context.Context, cfg *Config, msgs []Message, images []*imageInput, authToken string) ([]Message, []UpstreamFile, error) {
+	ids := make(map[*imageInput]string, len(images))
+	files := make([]UpstreamFile, 0, len(images))
+	for _, img := range images {
+		file, err := uploadFile(ctx, cfg, img, authToken)
+		if err != nil {
+			return nil, nil, err
+		}
+		ids[img] = file.ID
+		files = append(files, file)
+	}
+	out := make([]Message, len(msgs))
+	copy(out, msgs)
+	for i := range out {
+		if len(out[i].Parts) == 0 {
+			continue
+		}
+		parts := make([]ContentPart, len(out[i].Parts))
+		copy(parts, out[i].Parts)
+		for j := range parts {
+			if parts[j].image != nil {
+				parts[j].ImageURL = &ImageURL{URL: ids[parts[j].image]}
+			}
+		}
+		out[i].Parts = parts
+	}
+	return out, files, nil
+}
+
+// uploadStatusError 上游文件接口返回的非200状态，401/403/429 按凭证被拒绝处理
+type uploadStatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *uploadStatusError) Error() string {
+	return "upload image: upstream status " + e.Status
+}
+
+// uploadFile 通过上游文件接口上传一张图片
+func uploadFile(ctx context.Context, cfg *Config, img *imageInput, authToken string) (UpstreamFile, error) {
+	endpoint, err := upstreamFilesURL(cfg.UpstreamUrl)
+	if err != nil {
+		return UpstreamFile{}, err
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	h := make(map[string][]string)
+	h["Content-Disposition"] = []string{fmt.Sprintf(`form-data; name="file"; filename=%q`, img.name)}
+	h["Content-Type"] = []string{img.mime}
+	part, err := mw.CreatePart(h)
+	if err != nil {
+		return UpstreamFile{}, err
+	}
+	part.Write(img.data)
+	mw.Close()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, &body)
+	if err != nil {
+		return UpstreamFile{}, err
+	}
+	setBrowserHeaders(req, authToken, OriginBase+"/")
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+
+	debugLog("上传图片到上游: %s (%d bytes)", img.name, len(img.data))
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return UpstreamFile{}, fmt.Errorf("upload image: %w", err)
+	}
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		debugLog("图片上传失败: %s %s", resp.Status, string(raw))
+		return UpstreamFile{}, &uploadStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	var uploaded struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(raw, &uploaded); err != nil || uploaded.ID == "" {
+		return UpstreamFile{}, fmt.Errorf("upload image: unexpected response %q", string(raw))
+	}
+	debugLog("图片上传成功: %s", uploaded.ID)
+	return UpstreamFile{
+		Type:   "image",
+		File:   raw,
+		ID:     uploaded.ID,
+		URL:    "/api/v1/files/" + uploaded.ID + "/content",
+		Name:   img.name,
+		Status: "uploaded",
+		Size:   len(img.data),
+		ItemID: newItemID(),
+		Media:  "image",
+	}, nil
+}
+
+// upstreamFilesURL 由对话接口地址推出同一站点的文件上传地址
+func upstreamFilesURL(chatURL string) (string, error) {
+	u, err := url.Parse(chatURL)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid upstream url %q", chatURL)
+	}
+	return u.Scheme + "://" + u.Host + "/api/v1/files/", nil
+}
+
+func newItemID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
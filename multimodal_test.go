@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"2606:4700:4700::1111", true},
+		{"127.0.0.1", false},
+		{"127.8.9.10", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"172.31.255.255", false},
+		{"172.32.0.1", true},
+		{"192.168.1.1", false},
+		{"fd00::1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"::", false},
+		{"100.64.0.1", false},
+		{"100.128.0.1", true},
+		{"224.0.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+		{"::ffff:8.8.8.8", true},
+	}
+	for _, tt := range tests {
+		if got := publicIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("publicIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+// listenOn 在指定回环地址上启动测试服务器
+func listenOn(t *testing.T, addr string, h http.Handler) *httptest.Server {
+	t.Helper()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("无法监听 %s: %v", addr, err)
+	}
+	srv := &httptest.Server{Listener: l, Config: &http.Server{Handler: h}}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// 每一跳重定向都重新检查连接地址：公网地址重定向到内网时拒绝
+func TestFetchImageRejectsPrivateAddress(t *testing.T) {
+	private := listenOn(t, "127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("\x89PNG\r\n\x1a\n"))
+	}))
+	// 把 127.0.0.2 视为“公网”地址，作为重定向的第一跳
+	front := listenOn(t, "127.0.0.2:0", http.RedirectHandler(private.URL+"/img.png", http.StatusFound))
+	orig := imageAddrAllowed
+	imageAddrAllowed = func(ip net.IP) bool { return ip.Equal(net.IPv4(127, 0, 0, 2)) || publicIP(ip) }
+	t.Cleanup(func() { imageAddrAllowed = orig })
+
+	if _, err := fetchImage(context.Background(), private.URL+"/img.png", 1024); err == nil || !strings.Contains(err.Error(), errForbiddenImageAddr.Error()) {
+		t.Errorf("直接访问内网地址: err = %v", err)
+	}
+	if _, err := fetchImage(context.Background(), front.URL+"/redirect", 1024); err == nil || !strings.Contains(err.Error(), errForbiddenImageAddr.Error()) {
+		t.Errorf("重定向到内网地址: err = %v", err)
+	}
+}
+
+// 超过 max_image_bytes 的 base64 图片在解码前拒绝
+func TestLoadImageSizeLimit(t *testing.T) {
+	cfg := &Config{MaxImageBytes: 16}
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")
+	tests := []struct {
+		name    string
+		src     string
+		tooBig  bool
+		wantErr bool
+	}{
+		{"data URL 未超限", "data:image/png;base64," + base64.StdEncoding.EncodeToString(png), false, false},
+		{"纯 base64 未超限", base64.StdEncoding.EncodeToString(png), false, false},
+		{"data URL 超限", "data:image/png;base64," + base64.StdEncoding.EncodeToString(append(png, 0)), true, true},
+		{"纯 base64 超限", base64.StdEncoding.EncodeToString(append(png, 0)), true, true},
+		{"超限且不是合法 base64", strings.Repeat("!", 1<<20), true, true},
+		{"不是图片", base64.StdEncoding.EncodeToString([]byte("hello")), false, true},
+	}
+	for _, tt := range tests {
+		_, err := loadImage(context.Background(), cfg, tt.src)
+		if (err != nil) != tt.wantErr || errors.Is(err, errImageTooLarge) != tt.tooBig {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+	}
+}
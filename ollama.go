@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"z2api/thinking"
+)
+
+// Ollama 兼容接口：/api/chat、/api/generate、/api/tags、/api/show。
+// 流式响应为逐行JSON（NDJSON），思考内容放在 thinking 字段；模型列表与 /v1/models 相同
+
+// ollamaVersion /api/version 返回的版本号，部分客户端据此判断接口能力
+const ollamaVersion = "0.9.0"
+
+// OllamaMessage 对话消息；images 为纯 base64 图片
+type OllamaMessage struct {
+	Role     string   `json:"role"`
+	Content  string   `json:"content"`
+	Thinking string   `json:"thinking,omitempty"`
+	Images   []string `json:"images,omitempty"`
+}
+
+// OllamaOptions 生成参数（只使用 num_predict 与 stop，其余忽略）
+type OllamaOptions struct {
+	NumPredict int      `json:"num_predict,omitempty"` // 0 或负数表示不限制
+	Stop       []string `json:"stop,omitempty"`
+}
+
+// OllamaChatRequest /api/chat 请求
+type OllamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []OllamaMessage `json:"messages"`
+	Stream   *bool           `json:"stream,omitempty"` // 默认流式
+	Think    json.RawMessage `json:"think,omitempty"`  // true/false 或 low/medium/high
+	Format   json.RawMessage `json:"format,omitempty"`
+	Options  *OllamaOptions  `json:"options,omitempty"`
+	Tools    json.RawMessage `json:"tools,omitempty"`
+}
+
+// OllamaGenerateRequest /api/generate 请求
+type OllamaGenerateRequest struct {
+	Model   string          `json:"model"`
+	Prompt  string          `json:"prompt"`
+	System  string          `json:"system,omitempty"`
+	Images  []string        `json:"images,omitempty"`
+	Stream  *bool           `json:"stream,omitempty"`
+	Think   json.RawMessage `json:"think,omitempty"`
+	Format  json.RawMessage `json:"format,omitempty"`
+	Options *OllamaOptions  `json:"options,omitempty"`
+}
+
+// OllamaResponse /api/chat 与 /api/generate 的响应（流式时每行一个）
+type OllamaResponse struct {
+	Model         string         `json:"model"`
+	CreatedAt     string         `json:"created_at"`
+	Message       *OllamaMessage `json:"message,omitempty"`  // /api/chat
+	Response      *string        `json:"response,omitempty"` // /api/generate
+	Thinking      string         `json:"thinking,omitempty"` // /api/generate
+	Done          bool           `json:"done"`
+	DoneReason    string         `json:"done_reason,omitempty"`
+	TotalDuration int64          `json:"total_duration,omitempty"`
+}
+
+// OllamaModel /api/tags 中的模型
+type OllamaModel struct {
+	Name       string             `json:"name"`
+	Model      string             `json:"model"`
+	ModifiedAt string             `json:"modified_at"`
+	Size       int64              `json:"size"`
+	Digest     string             `json:"digest"`
+	Details    OllamaModelDetails `json:"details"`
+}
+
+// OllamaModelDetails 模型详情（上游不提供，使用固定值）
+type OllamaModelDetails struct {
+	Format            string   `json:"format"`
+	Family            string   `json:"family"`
+	Families          []string `json:"families"`
+	ParameterSize     string   `json:"parameter_size"`
+	QuantizationLevel string   `json:"quantization_level"`
+}
+
+var ollamaDetails = OllamaModelDetails{Format: "api", Family: "glm", Families: []string{"glm"}, ParameterSize: "355B", QuantizationLevel: "none"}
+
+func writeOllamaError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// ollamaErrors 供鉴权与限流中间件使用的 Ollama 格式错误
+func ollamaErrors(w http.ResponseWriter, status int, _, _ string, message string) {
+	writeOllamaError(w, status, message)
+}
+
+// ollamaModelName 去掉客户端常加的 :latest 标签
+func ollamaModelName(name string) string {
+	return strings.TrimSuffix(name, ":latest")
+}
+
+// ollamaThink 解析 think 参数；未指定时使用模型默认值
+func ollamaThink(raw json.RawMessage, modelDefault bool) (bool, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || string(raw) == "null" {
+		return modelDefault, nil
+	}
+	var on bool
+	if err := json.Unmarshal(raw, &on); err == nil {
+		return on, nil
+	}
+	var effort string
+	if err := json.Unmarshal(raw, &effort); err != nil {
+		return false, fmt.Errorf("think must be a boolean or one of low, medium, high")
+	}
+	return parseEffort(effort)
+}
+
+// ollamaImages 把 base64 图片转换为图片片段
+func ollamaImages(images []string) []ContentPart {
+	var parts []ContentPart
+	for _, img := range images {
+		parts = append(parts, ContentPart{Type: "image_url", ImageURL: &ImageURL{URL: img}})
+	}
+	return parts
+}
+
+func handleOllamaTags(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	cfg := configFromContext(r.Context())
+	apiKey := apiKeyFromContext(r.Context())
+
+	models := []OllamaModel{}
+	for _, m := range availableModels(cfg, apiKey) {
+		models = append(models, OllamaModel{
+			Name:       m.ID,
+			Model:      m.ID,
+			ModifiedAt: time.Unix(m.Created, 0).UTC().Format(time.RFC3339),
+			Digest:     m.ID,
+			Details:    ollamaDetails,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"models": models})
+}
+
+func handleOllamaShow(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	cfg := configFromContext(r.Context())
+	apiKey := apiKeyFromContext(r.Context())
+
+	var req struct {
+		Model string `json:"model"`
+		Name  string `json:"name"` // 旧版字段
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeOllamaError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	name := ollamaModelName(req.Model)
+	if name == "" {
+		name = ollamaModelName(req.Name)
+	}
+	for _, m := range availableModels(cfg, apiKey) {
+		if m.ID != name {
+			continue
+		}
+		capabilities := []string{"completion", "thinking"}
+		if cfg.VisionModel != "" {
+			capabilities = append(capabilities, "vision")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"modelfile":    "",
+			"parameters":   "",
+			"template":     "",
+			"details":      ollamaDetails,
+			"model_info":   map[string]any{"general.architecture": "glm"},
+			"capabilities": capabilities,
+			"modified_at":  time.Unix(m.Created, 0).UTC().Format(time.RFC3339),
+		})
+		return
+	}
+	writeOllamaError(w, http.StatusNotFound, fmt.Sprintf("model '%s' not found", name))
+}
+
+func handleOllamaVersion(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"version": ollamaVersion})
+}
+
+func handleOllamaChat(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	debugLog("收到Ollama chat请求")
+	metrics.Requests.Add(1)
+
+	var req OllamaChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		debugLog("JSON解析失败: %v", err)
+		writeOllamaError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	if len(req.Tools) > 0 && string(req.Tools) != "null" && string(req.Tools) != "[]" {
+		writeOllamaError(w, http.StatusBadRequest, "tools are not supported on /api/chat, use /v1/chat/completions")
+		return
+	}
+	var messages []Message
+	for i, m := range req.Messages {
+		switch m.Role {
+		case "system", "user", "assistant":
+		default:
+			writeOllamaError(w, http.StatusBadRequest, fmt.Sprintf("messages[%d]: unsupported role %q", i, m.Role))
+			return
+		}
+		messages = append(messages, Message{Role: m.Role, Content: m.Content, Parts: ollamaImages(m.Images)})
+	}
+	serveOllama(w, r, ollamaTurn{
+		model:    ollamaModelName(req.Model),
+		chat:     true,
+		messages: messages,
+		stream:   req.Stream,
+		think:    req.Think,
+		format:   req.Format,
+		options:  req.Options,
+	})
+}
+
+func handleOllamaGenerate(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	debugLog("收到Ollama generate请求")
+	metrics.Requests.Add(1)
+
+	var req OllamaGenerateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		debugLog("JSON解析失败: %v", err)
+		writeOllamaError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	var messages []Message
+	if req.System != "" {
+		messages = append(messages, Message{Role: "system", Content: req.System})
+	}
+	if req.Prompt != "" || len(req.Images) > 0 {
+		messages = append(messages, Message{Role: "user", Content: req.Prompt, Parts: ollamaImages(req.Images)})
+	}
+	serveOllama(w, r, ollamaTurn{
+		model:    ollamaModelName(req.Model),
+		messages: messages,
+		stream:   req.Stream,
+		think:    req.Think,
+		format:   req.Format,
+		options:  req.Options,
+	})
+}
+
+// ollamaTurn /api/chat 与 /api/generate 解析后的公共部分
+type ollamaTurn struct {
+	model    string
+	chat     bool // 响应使用 message 字段（/api/chat）还是 response 字段（/api/generate）
+	messages []Message
+	stream   *bool
+	think    json.RawMessage
+	format   json.RawMessage
+	options  *OllamaOptions
+}
+
+func serveOllama(w http.ResponseWriter, r *http.Request, t ollamaTurn) {
+	cfg := configFromContext(r.Context())
+	apiKey := apiKeyFromContext(r.Context())
+	start := time.Now()
+
+	if !apiKey.allowsModel(t.model) {
+		debugLog("密钥 %s 无权访问模型: %s", apiKey.ID, t.model)
+		writeOllamaError(w, http.StatusForbidden, "model not allowed for this API key")
+		return
+	}
+	if f := bytes.TrimSpace(t.format); len(f) > 0 && string(f) != "null" && string(f) != `""` {
+		writeOllamaError(w, http.StatusBadRequest, "format is not supported, use response_format on /v1/chat/completions")
+		return
+	}
+	stream := t.stream == nil || *t.stream
+	out := &ollamaOutput{w: w, model: t.model, chat: t.chat, stream: stream}
+
+	// 没有消息时 Ollama 只加载模型并立即返回
+	if !hasUserContent(t.messages) {
+		out.done(start, "load")
+		return
+	}
+
+	isThinking, isSearch := modelFeatures(t.model)
+	isThinking, err := ollamaThink(t.think, isThinking)
+	if err != nil {
+		writeOllamaError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	images, err := prepareImages(r.Context(), cfg, t.messages)
+	if err != nil {
+		writeOllamaError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	upstreamReq := newUpstreamRequest(cfg, t.messages, images, isThinking, isSearch)
+	limits := &turnLimits{}
+	if o := t.options; o != nil {
+		if o.NumPredict > 0 {
+			upstreamReq.Params["max_tokens"] = o.NumPredict
+			limits.contentBudget = newTokenBudget(o.NumPredict)
+		}
+		if len(o.Stop) > 0 {
+			upstreamReq.Params["stop"] = o.Stop
+			limits.stop = newStopMatcher(o.Stop)
+		}
+	}
+	debugLog("请求解析成功 - 模型: %s, 流式: %v, 消息数: %d, 思考: %v", t.model, stream, len(t.messages), isThinking)
+
+	ctx, cancel := withUpstreamDeadlines(r.Context(), resolveDeadlines(cfg, t.model, r.Header))
+	defer cancel()
+
+	err = runUpstream(ctx, cfg, upstreamReq, newAuthChain(cfg), thinking.ModeStrip, func(isReasoning bool, s string) bool {
+		kind, text, more := limits.accept(isReasoning, s)
+		out.delta(kind, text)
+		return more
+	})
+	if err != nil {
+		out.fail(ctx, cfg, err)
+		return
+	}
+	out.delta("text", limits.finish())
+
+	reason := "stop"
+	if limits.contentBudget.exhausted() {
+		reason = "length"
+	}
+	out.done(start, reason)
+	metrics.Completed.Add(1)
+	debugLog("Ollama响应完成 (done_reason=%s)", reason)
+}
+
+// hasUserContent 是否有需要模型回答的消息（只有 system 消息时视为加载模型）
+func hasUserContent(msgs []Message) bool {
+	for _, m := range msgs {
+		if m.Role != "system" {
+			return true
+		}
+	}
+	return false
+}
+
+// ollamaOutput 输出 Ollama 响应：流式时每个增量一行，非流式时收集后返回一个对象。
+// 第一行在收到首个增量时才发送，上游在输出前失败时仍可返回HTTP错误
+type ollamaOutput struct {
+	w       http.ResponseWriter
+	model   string
+	chat    bool
+	stream  bool
+	started bool
+
+	thinking strings.Builder
+	content  strings.Builder
+}
+
+func (o *ollamaOutput) frame(content, thinking string, done bool) OllamaResponse {
+	resp := OllamaResponse{Model: o.model, CreatedAt: time.Now().UTC().Format(time.RFC3339Nano), Done: done}
+	if o.chat {
+		resp.Message = &OllamaMessage{Role: "assistant", Content: content, Thinking: thinking}
+	} else {
+		resp.Response = &content
+		resp.Thinking = thinking
+	}
+	return resp
+}
+
+func (o *ollamaOutput) write(resp OllamaResponse) {
+	if !o.started {
+		o.started = true
+		if o.stream {
+			o.w.Header().Set("Content-Type", "application/x-ndjson")
+		} else {
+			o.w.Header().Set("Content-Type", "application/json")
+		}
+	}
+	json.NewEncoder(o.w).Encode(resp)
+	if f, ok := o.w.(http.Flusher); ok && o.stream {
+		f.Flush()
+	}
+}
+
+func (o *ollamaOutput) delta(kind, text string) {
+	if text == "" {
+		return
+	}
+	if !o.stream {
+		if kind == "thinking" {
+			o.thinking.WriteString(text)
+		} else {
+			o.content.WriteString(text)
+		}
+		return
+	}
+	if kind == "thinking" {
+		o.write(o.frame("", text, false))
+	} else {
+		o.write(o.frame(text, "", false))
+	}
+}
+
+// done 发送最后一行（非流式时为完整回答）
+func (o *ollamaOutput) done(start time.Time, reason string) {
+	resp := o.frame(o.content.String(), o.thinking.String(), true)
+	resp.DoneReason = reason
+	resp.TotalDuration = time.Since(start).Nanoseconds()
+	o.write(resp)
+}
+
+// fail 上游失败：尚未输出时返回HTTP错误，否则以一行 {"error": ...} 结束
+func (o *ollamaOutput) fail(ctx context.Context, cfg *Config, err error) {
+	f, ok := describeUpstreamFailure(ctx, o.w, cfg, err)
+	if !ok {
+		return
+	}
+	if !o.started {
+		writeOllamaError(o.w, f.Status, f.Message)
+		return
+	}
+	json.NewEncoder(o.w).Encode(map[string]string{"error": f.Message})
+	if fl, ok := o.w.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
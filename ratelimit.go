@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// bucket 单个密钥的令牌桶与并发计数
+type bucket struct {
+	mu     sync.Mutex
+	rpm    int
+	tokens float64
+	last   time.Time
+	active int
+}
+
+// rateDecision 一次限流判定的结果，用于输出 x-ratelimit-* 头
+type rateDecision struct {
+	allowed    bool
+	limit      int
+	remaining  int
+	reset      time.Duration // 令牌桶恢复满额所需时间
+	retryAfter time.Duration // 被拒绝时建议的重试等待
+}
+
+// take 尝试一次性消耗 n 个令牌，不足时一个也不消耗（rpm<=0 表示不限制）
+func (b *bucket) take(rpm, n int, now time.Time) rateDecision {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if rpm <= 0 {
+		return rateDecision{allowed: true}
+	}
+	if b.rpm != rpm {
+		// 限额变化（配置热加载或密钥更新）时重置令牌桶
+		b.rpm = rpm
+		b.tokens = float64(rpm)
+		b.last = now
+	}
+	perSec := float64(rpm) / 60
+	b.tokens = math.Min(float64(rpm), b.tokens+now.Sub(b.last).Seconds()*perSec)
+	b.last = now
+
+	d := rateDecision{limit: rpm}
+	if b.tokens >= float64(n) {
+		b.tokens -= float64(n)
+		d.allowed = true
+	} else {
+		d.retryAfter = time.Duration((float64(n) - b.tokens) / perSec * float64(time.Second))
+	}
+	d.remaining = int(b.tokens)
+	d.reset = time.Duration((float64(rpm) - b.tokens) / perSec * float64(time.Second))
+	return d
+}
+
+// acquire 占用一个并发名额（max<=0 表示不限制）
+func (b *bucket) acquire(max int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if max > 0 && b.active >= max {
+		return false
+	}
+	b.active++
+	return true
+}
+
+func (b *bucket) release() {
+	b.mu.Lock()
+	b.active--
+	b.mu.Unlock()
+}
+
+// RateLimiter 按密钥ID维护令牌桶
+type RateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+var rateLimiter = &RateLimiter{buckets: map[string]*bucket{}}
+
+func (l *RateLimiter) get(id string) *bucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[id]
+	if !ok {
+		b = &bucket{}
+		l.buckets[id] = b
+	}
+	return b
+}
+
+// keyLimits 计算密钥实际生效的限额：密钥自身设置优先，否则取配置默认值
+func keyLimits(cfg *Config, key *APIKey) (rpm int, maxConcurrent int) {
+	rpm, maxConcurrent = cfg.RateLimitRPM, cfg.MaxConcurrentStreams
+	if key.RPM > 0 {
+		rpm = key.RPM
+	}
+	if key.MaxConcurrent > 0 {
+		maxConcurrent = key.MaxConcurrent
+	}
+	return rpm, maxConcurrent
+}
+
+// formatReset 按OpenAI风格格式化重置时间，如 "1s"、"6m0s"、"250ms"
+func formatReset(d time.Duration) string {
+	if d < time.Second {
+		return fmt.Sprintf("%dms", d.Milliseconds())
+	}
+	return d.Round(time.Second).String()
+}
+
+// withRateLimit 限流中间件（需位于 withAuth 之后）：每分钟请求数与最大并发流
+func withRateLimit(errs apiErrorWriter, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := apiKeyFromContext(r.Context())
+		if r.Method == "OPTIONS" || key == nil {
+			next(w, r)
+			return
+		}
+		cfg := configFromContext(r.Context())
+		rpm, maxConcurrent := keyLimits(cfg, key)
+		b := rateLimiter.get(key.ID)
+
+		if !writeRateDecision(w, errs, key, b.take(rpm, 1, time.Now())) {
+			return
+		}
+
+		if !b.acquire(maxConcurrent) {
+			debugLog("密钥 %s 超出并发限制 (%d)", key.ID, maxConcurrent)
+			w.Header().Set("Retry-After", "1")
+			errs(w, http.StatusTooManyRequests, "requests", "rate_limit_exceeded",
+				fmt.Sprintf("Too many concurrent requests: limit %d. Please try again later.", maxConcurrent))
+			return
+		}
+		defer b.release()
+
+		next(w, r)
+	}
+}
+
+// writeRateDecision 输出 x-ratelimit-* 头；被拒绝时按 errs 的格式返回429并返回 false
+func writeRateDecision(w http.ResponseWriter, errs apiErrorWriter, key *APIKey, d rateDecision) bool {
+	if d.limit > 0 {
+		w.Header().Set("x-ratelimit-limit-requests", strconv.Itoa(d.limit))
+		w.Header().Set("x-ratelimit-remaining-requests", strconv.Itoa(d.remaining))
+		w.Header().Set("x-ratelimit-reset-requests", formatReset(d.reset))
+	}
+	if d.allowed {
+		return true
+	}
+	debugLog("密钥 %s 超出请求频率限制 (%d/min)", key.ID, d.limit)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.retryAfter.Seconds()))))
+	errs(w, http.StatusTooManyRequests, "requests", "rate_limit_exceeded",
+		fmt.Sprintf("Rate limit reached for requests: limit %d per minute. Please try again in %s.", d.limit, formatReset(d.retryAfter)))
+	return false
+}
+
+// chargeRequests 一个HTTP请求包含多次上游对话时（如数组 prompt），为 withRateLimit 已计入的一次之外的 n 次对话扣除令牌；
+// 超出限额时按 errs 的格式返回429并返回 false
+func chargeRequests(w http.ResponseWriter, r *http.Request, errs apiErrorWriter, n int) bool {
+	key := apiKeyFromContext(r.Context())
+	if n <= 0 || key == nil {
+		return true
+	}
+	rpm, _ := keyLimits(configFromContext(r.Context()), key)
+	return writeRateDecision(w, errs, key, rateLimiter.get(key.ID).take(rpm, n, time.Now()))
+}
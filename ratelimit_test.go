@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBucketRefill(t *testing.T) {
+	var b bucket
+	now := time.Unix(1000, 0)
+
+	// 初始满额：60/min 可以连续取60次
+	for i := 0; i < 60; i++ {
+		if d := b.take(60, 1, now); !d.allowed {
+			t.Fatalf("第%d次被拒绝", i+1)
+		}
+	}
+	d := b.take(60, 1, now)
+	if d.allowed || d.remaining != 0 || d.retryAfter != time.Second || d.reset != time.Minute {
+		t.Fatalf("耗尽后 = %+v", d)
+	}
+
+	// 每秒恢复一个令牌
+	if d := b.take(60, 1, now.Add(500*time.Millisecond)); d.allowed {
+		t.Fatal("半个令牌不应放行")
+	}
+	if d := b.take(60, 1, now.Add(time.Second)); !d.allowed {
+		t.Fatal("1秒后应恢复一个令牌")
+	}
+
+	// 恢复不超过上限
+	d = b.take(60, 1, now.Add(time.Hour))
+	if !d.allowed || d.remaining != 59 {
+		t.Fatalf("长时间空闲后 = %+v", d)
+	}
+}
+
+func TestBucketTakeN(t *testing.T) {
+	var b bucket
+	now := time.Unix(1000, 0)
+	if d := b.take(10, 8, now); !d.allowed || d.remaining != 2 {
+		t.Fatalf("take 8 = %+v", d)
+	}
+	// 不足时一个也不扣
+	d := b.take(10, 3, now)
+	if d.allowed || d.remaining != 2 || d.retryAfter != 6*time.Second {
+		t.Fatalf("take 3 = %+v", d)
+	}
+	if d := b.take(10, 2, now); !d.allowed {
+		t.Fatal("被拒绝的请求不应消耗令牌")
+	}
+}
+
+func TestBucketLimitChangeResets(t *testing.T) {
+	var b bucket
+	now := time.Unix(1000, 0)
+	b.take(2, 2, now)
+	if d := b.take(2, 1, now); d.allowed {
+		t.Fatal("应已耗尽")
+	}
+	// 限额变化（热加载）时令牌桶重置为新的满额
+	if d := b.take(5, 1, now); !d.allowed || d.remaining != 4 {
+		t.Fatalf("限额变化后 = %+v", d)
+	}
+	if d := b.take(0, 100, now); !d.allowed || d.limit != 0 {
+		t.Fatalf("rpm=0 应不限制: %+v", d)
+	}
+}
+
+func TestBucketConcurrency(t *testing.T) {
+	var b bucket
+	if !b.acquire(2) || !b.acquire(2) {
+		t.Fatal("前两个并发应放行")
+	}
+	if b.acquire(2) {
+		t.Fatal("第三个并发应被拒绝")
+	}
+	b.release()
+	if !b.acquire(2) {
+		t.Fatal("释放后应放行")
+	}
+	if !b.acquire(0) {
+		t.Fatal("max=0 应不限制")
+	}
+}
+
+func TestFormatReset(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{250 * time.Millisecond, "250ms"},
+		{1400 * time.Millisecond, "1s"},
+		{6 * time.Minute, "6m0s"},
+	}
+	for _, tt := range tests {
+		if got := formatReset(tt.d); got != tt.want {
+			t.Errorf("formatReset(%v) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestWithRateLimit(t *testing.T) {
+	cfg := &Config{RateLimitRPM: 1}
+	key := &APIKey{ID: "ratelimit-test"}
+	ctx := context.WithValue(context.WithValue(context.Background(), ctxKeyConfig, cfg), ctxKeyAPIKey, key)
+	h := withRateLimit(anthropicErrors, func(w http.ResponseWriter, r *http.Request) {})
+
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest("POST", "/v1/messages", nil).WithContext(ctx))
+	if rec.Code != http.StatusOK || rec.Header().Get("x-ratelimit-limit-requests") != "1" {
+		t.Fatalf("首个请求: %d %v", rec.Code, rec.Header())
+	}
+
+	rec = httptest.NewRecorder()
+	h(rec, httptest.NewRequest("POST", "/v1/messages", nil).WithContext(ctx))
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "60" {
+		t.Fatalf("第二个请求: %d %v", rec.Code, rec.Header())
+	}
+	// 错误使用路由对应接口的格式
+	if body := rec.Body.String(); !strings.Contains(body, `"type":"rate_limit_error"`) {
+		t.Errorf("429 响应体不是 Anthropic 格式: %s", body)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"z2api/thinking"
+)
+
+// 推理（思考）内容的输出格式
+const (
+	ReasoningFormatSeparate = "reasoning_content" // 放在 reasoning_content 字段（默认）
+	ReasoningFormatInline   = "inline"            // 以 <think>...</think> 内联在 content 开头
+	ReasoningFormatHidden   = "hidden"            // 不返回推理内容
+)
+
+// HeaderReasoningFormat 客户端可通过该请求头选择推理输出格式
+const HeaderReasoningFormat = "X-Reasoning-Format"
+
+// parseReasoningFormat 解析推理输出格式，兼容 Groq 风格的 parsed/raw 写法
+func parseReasoningFormat(s string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case ReasoningFormatSeparate, "parsed", "separate":
+		return ReasoningFormatSeparate, nil
+	case ReasoningFormatInline, "raw", "think":
+		return ReasoningFormatInline, nil
+	case ReasoningFormatHidden, "none":
+		return ReasoningFormatHidden, nil
+	}
+	return "", fmt.Errorf("invalid reasoning_format %q (expected reasoning_content, inline or hidden)", s)
+}
+
+// resolveReasoningFormat 按 请求字段 > 请求头 > 密钥默认 > 全局配置 的优先级确定推理输出格式，
+// 再应用 include_reasoning 与 reasoning.exclude 的开关（无论格式来自哪里）
+func resolveReasoningFormat(cfg *Config, key *APIKey, req *OpenAIRequest, h http.Header) (string, error) {
+	raw := cfg.ReasoningFormat
+	if key.ReasoningFormat != "" {
+		raw = key.ReasoningFormat
+	}
+	if v := h.Get(HeaderReasoningFormat); v != "" {
+		raw = v
+	}
+	if req.ReasoningFormat != "" {
+		raw = req.ReasoningFormat
+	}
+	format, err := parseReasoningFormat(raw)
+	if err != nil {
+		return "", err
+	}
+	if req.Reasoning != nil && req.Reasoning.Exclude {
+		return ReasoningFormatHidden, nil
+	}
+	if req.IncludeReasoning != nil {
+		if !*req.IncludeReasoning {
+			return ReasoningFormatHidden, nil
+		}
+		if format == ReasoningFormatHidden {
+			return ReasoningFormatSeparate, nil
+		}
+	}
+	return format, nil
+}
+
+// ReasoningOptions OpenRouter 风格的推理设置
+type ReasoningOptions struct {
+	Enabled   *bool  `json:"enabled,omitempty"`
+	Effort    string `json:"effort,omitempty"`
+	Exclude   bool   `json:"exclude,omitempty"`    // 上游照常思考，但不返回推理内容
+	MaxTokens int    `json:"max_tokens,omitempty"` // 推理内容预算
+}
+
+// reasoningOutput 单个请求的推理输出设置
+type reasoningOutput struct {
+	Format    string
+	MaxTokens int // 推理内容的本地截断预算（估算token），0表示不限制
+}
+
+// parseEffort 解析推理强度，返回是否开启思考
+// 上游只有思考开关而没有强度参数，minimal/low/medium/high 都只是开启思考
+func parseEffort(effort string) (bool, error) {
+	switch strings.ToLower(effort) {
+	case "none":
+		return false, nil
+	case "minimal", "low", "medium", "high":
+		return true, nil
+	}
+	return false, fmt.Errorf("invalid reasoning effort %q (expected none, minimal, low, medium or high)", effort)
+}
+
+// enableThinking 根据 reasoning 对象与 reasoning_effort 决定是否开启上游思考，都未指定时使用模型默认值
+func enableThinking(req *OpenAIRequest, modelDefault bool) (bool, error) {
+	if r := req.Reasoning; r != nil {
+		if r.MaxTokens < 0 {
+			return false, fmt.Errorf("reasoning.max_tokens must not be negative")
+		}
+		if r.Effort != "" {
+			on, err := parseEffort(r.Effort)
+			if err != nil {
+				return false, err
+			}
+			if r.Enabled == nil {
+				return on, nil
+			}
+		}
+		if r.Enabled != nil {
+			return *r.Enabled, nil
+		}
+		// 只给出 reasoning 对象（如仅 max_tokens 或 exclude）也视为开启
+		return true, nil
+	}
+	if req.ReasoningEffort != "" {
+		return parseEffort(req.ReasoningEffort)
+	}
+	return modelDefault, nil
+}
+
+// reasoningBudget 请求的推理内容预算，0表示不限制
+func (r *OpenAIRequest) reasoningBudget() int {
+	if r.Reasoning == nil {
+		return 0
+	}
+	return r.Reasoning.MaxTokens
+}
+
+// tokenBudget 推理内容的本地token预算
+// 上游没有思考预算参数，只能在输出时截断；token数按 ASCII 每4字符、其他每字符1个估算
+type tokenBudget struct {
+	limit int // 以1/4 token为单位
+	used  int
+	cut   bool
+}
+
+// newTokenBudget 创建预算，maxTokens 为0时返回 nil（不限制）
+func newTokenBudget(maxTokens int) *tokenBudget {
+	if maxTokens <= 0 {
+		return nil
+	}
+	return &tokenBudget{limit: maxTokens * 4}
+}
+
+// take 返回 s 中仍在预算内的部分
+func (b *tokenBudget) take(s string) string {
+	if b == nil || s == "" {
+		return s
+	}
+	if b.cut {
+		return ""
+	}
+	for i, r := range s {
+		cost := 4
+		if r < utf8.RuneSelf {
+			cost = 1
+		}
+		if b.used+cost > b.limit {
+			b.cut = true
+			debugLog("推理内容超出预算 %d tokens，已截断", b.limit/4)
+			return s[:i]
+		}
+		b.used += cost
+	}
+	return s
+}
+
+// exhausted 预算是否已用尽（发生过截断）
+func (b *tokenBudget) exhausted() bool {
+	return b != nil && b.cut
+}
+
+// thinkTagsMode 内联格式由代理自行添加 <think> 标签，上游的 <details> 一律去除
+func thinkTagsMode(cfg *Config, format string) string {
+	if format == ReasoningFormatInline {
+		return thinking.ModeStrip
+	}
+	return cfg.ThinkTagsMode
+}
+
+// completion 非流式响应中分别收集的推理与回答内容
+type completion struct {
+	reasoning strings.Builder
+	content   strings.Builder
+	budget    *tokenBudget
+}
+
+func (c *completion) empty() bool {
+	return c.reasoning.Len() == 0 && c.content.Len() == 0
+}
+
+// message 按推理输出格式组装最终的 assistant 消息
+func (c *completion) message(format string) Message {
+	msg := Message{Role: "assistant", Content: c.content.String()}
+	reasoning := c.reasoning.String()
+	if reasoning == "" {
+		return msg
+	}
+	switch format {
+	case ReasoningFormatSeparate:
+		msg.ReasoningContent = reasoning
+	case ReasoningFormatInline:
+		msg.Content = "<think>\n" + reasoning + "\n</think>\n\n" + msg.Content
+	}
+	return msg
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestResolveReasoningFormat(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		name   string
+		cfg    string
+		key    string
+		header string
+		req    OpenAIRequest
+		want   string
+	}{
+		{"全局默认", ReasoningFormatSeparate, "", "", OpenAIRequest{}, ReasoningFormatSeparate},
+		{"密钥覆盖全局", ReasoningFormatSeparate, "inline", "", OpenAIRequest{}, ReasoningFormatInline},
+		{"请求头覆盖密钥", ReasoningFormatSeparate, "inline", "hidden", OpenAIRequest{}, ReasoningFormatHidden},
+		{"请求字段优先", ReasoningFormatSeparate, "hidden", "hidden", OpenAIRequest{ReasoningFormat: "raw"}, ReasoningFormatInline},
+		{"请求字段 + exclude", ReasoningFormatSeparate, "", "", OpenAIRequest{ReasoningFormat: "inline", Reasoning: &ReasoningOptions{Exclude: true}}, ReasoningFormatHidden},
+		{"请求字段 + include_reasoning:false", ReasoningFormatSeparate, "", "", OpenAIRequest{ReasoningFormat: "parsed", IncludeReasoning: &no}, ReasoningFormatHidden},
+		{"请求头 + include_reasoning:false", ReasoningFormatSeparate, "", "inline", OpenAIRequest{IncludeReasoning: &no}, ReasoningFormatHidden},
+		{"include_reasoning:true 取消隐藏", ReasoningFormatHidden, "", "", OpenAIRequest{IncludeReasoning: &yes}, ReasoningFormatSeparate},
+		{"include_reasoning:true 保留 inline", ReasoningFormatSeparate, "", "", OpenAIRequest{ReasoningFormat: "inline", IncludeReasoning: &yes}, ReasoningFormatInline},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		if tt.header != "" {
+			h.Set(HeaderReasoningFormat, tt.header)
+		}
+		got, err := resolveReasoningFormat(&Config{ReasoningFormat: tt.cfg}, &APIKey{ReasoningFormat: tt.key}, &tt.req, h)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %q, %v; want %q", tt.name, got, err, tt.want)
+		}
+	}
+
+	if _, err := resolveReasoningFormat(&Config{ReasoningFormat: ReasoningFormatSeparate}, &APIKey{}, &OpenAIRequest{ReasoningFormat: "bogus"}, http.Header{}); err == nil {
+		t.Error("无效的 reasoning_format 应返回错误")
+	}
+}
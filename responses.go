@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"z2api/thinking"
+)
+
+// OpenAI Responses API（/v1/responses）：input/instructions 转换为上游对话，
+// 思考阶段输出为 reasoning 项（summary_text），回答输出为 message 项；
+// 完成的响应连同对话历史保存在内存中，供 previous_response_id 续接
+
+// ResponsesRequest 创建响应的请求
+type ResponsesRequest struct {
+	Model              string              `json:"model"`
+	Input              json.RawMessage     `json:"input"` // 字符串或输入项数组
+	Instructions       string              `json:"instructions,omitempty"`
+	Reasoning          *ResponsesReasoning `json:"reasoning,omitempty"`
+	PreviousResponseID string              `json:"previous_response_id,omitempty"`
+	MaxOutputTokens    int                 `json:"max_output_tokens,omitempty"`
+	Store              *bool               `json:"store,omitempty"`
+	Stream             bool                `json:"stream,omitempty"`
+	Metadata           map[string]string   `json:"metadata,omitempty"`
+	Tools              json.RawMessage     `json:"tools,omitempty"`
+}
+
+// ResponsesReasoning reasoning 设置；上游只有思考开关，summary 的取值不影响输出
+type ResponsesReasoning struct {
+	Effort  string `json:"effort,omitempty"`
+	Summary string `json:"summary,omitempty"`
+}
+
+// ResponsesInputItem 输入项（目前只支持消息与回传的 reasoning 项）
+type ResponsesInputItem struct {
+	Type    string          `json:"type,omitempty"`
+	Role    string          `json:"role,omitempty"`
+	Content json.RawMessage `json:"content,omitempty"`
+}
+
+// ResponsesContentPart 输入消息的内容片段
+type ResponsesContentPart struct {
+	Type     string `json:"type"` // input_text / output_text / input_image
+	Text     string `json:"text,omitempty"`
+	ImageURL string `json:"image_url,omitempty"`
+}
+
+// ResponseObject 响应对象
+type ResponseObject struct {
+	ID                 string              `json:"id"`
+	Object             string              `json:"object"`
+	CreatedAt          int64               `json:"created_at"`
+	Status             string              `json:"status"` // in_progress / completed / incomplete / failed
+	Model              string              `json:"model"`
+	Output             []any               `json:"output"`
+	Instructions       *string             `json:"instructions"`
+	PreviousResponseID *string             `json:"previous_response_id"`
+	Reasoning          *ResponsesReasoning `json:"reasoning,omitempty"`
+	MaxOutputTokens    *int                `json:"max_output_tokens"`
+	IncompleteDetails  *IncompleteDetails  `json:"incomplete_details"`
+	Error              *ResponseError      `json:"error"`
+	Store              bool                `json:"store"`
+	Metadata           map[string]string   `json:"metadata"`
+	Usage              ResponsesUsage      `json:"usage"`
+}
+
+// IncompleteDetails 响应未完成的原因
+type IncompleteDetails struct {
+	Reason string `json:"reason"`
+}
+
+// ResponseError 失败响应的错误
+type ResponseError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ResponsesUsage 用量（上游不返回，固定为0）
+type ResponsesUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+type responseMessageItem struct {
+	Type    string               `json:"type"`
+	ID      string               `json:"id"`
+	Status  string               `json:"status"`
+	Role    string               `json:"role"`
+	Content []responseOutputText `json:"content"`
+}
+
+type responseOutputText struct {
+	Type        string `json:"type"`
+	Text        string `json:"text"`
+	Annotations []any  `json:"annotations"`
+}
+
+type responseReasoningItem struct {
+	Type    string                `json:"type"`
+	ID      string                `json:"id"`
+	Summary []responseSummaryText `json:"summary"`
+}
+
+type responseSummaryText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+func newResponseID(prefix string) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return prefix + "_" + hex.EncodeToString(b)
+}
+
+// responsesInput 把 input 转换为消息：字符串视为一条 user 消息，developer 角色按 system 处理
+func responsesInput(raw json.RawMessage) ([]Message, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("input is required")
+	}
+	if raw[0] == '"' {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, err
+		}
+		return []Message{{Role: "user", Content: s}}, nil
+	}
+	var items []ResponsesInputItem
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return nil, fmt.Errorf("input must be a string or an array of items")
+	}
+	var msgs []Message
+	for i, item := range items {
+		switch item.Type {
+		case "", "message":
+		case "reasoning":
+			continue
+		default:
+			return nil, fmt.Errorf("input[%d]: unsupported item type %q", i, item.Type)
+		}
+		role := item.Role
+		switch role {
+		case "developer":
+			role = "system"
+		case "user", "assistant", "system":
+		default:
+			return nil, fmt.Errorf("input[%d]: unexpected role %q", i, item.Role)
+		}
+		text, parts, err := responsesContent(item.Content)
+		if err != nil {
+			return nil, fmt.Errorf("input[%d].content: %v", i, err)
+		}
+		msgs = append(msgs, Message{Role: role, Content: text, Parts: parts})
+	}
+	return msgs, nil
+}
+
+func responsesContent(raw json.RawMessage) (string, []ContentPart, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || raw[0] != '[' {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return "", nil, fmt.Errorf("expected a string or an array of content parts")
+		}
+		return s, nil, nil
+	}
+	var items []ResponsesContentPart
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return "", nil, err
+	}
+	var texts []string
+	var parts []ContentPart
+	for _, p := range items {
+		switch p.Type {
+		case "input_text", "output_text", "text":
+			texts = append(texts, p.Text)
+		case "input_image":
+			if p.ImageURL == "" {
+				return "", nil, fmt.Errorf("input_image without image_url (file_id is not supported)")
+			}
+			parts = append(parts, ContentPart{Type: "image_url", ImageURL: &ImageURL{URL: p.ImageURL}})
+		default:
+			return "", nil, fmt.Errorf("unsupported content part type %q", p.Type)
+		}
+	}
+	return strings.Join(texts, "\n"), parts, nil
+}
+
+// responseStore 已完成响应的内存存储，按密钥隔离，超过容量时淘汰最早的响应
+type responseStore struct {
+	mu    sync.Mutex
+	items map[string]*storedResponse
+	order []string // 按写入顺序
+}
+
+type storedResponse struct {
+	owner    string // 创建该响应的密钥ID
+	expires  time.Time
+	response ResponseObject
+	history  []Message // 不含 instructions 的完整对话（含本次回答）
+}
+
+var responses = &responseStore{items: map[string]*storedResponse{}}
+
+func (s *responseStore) put(cfg *Config, owner string, resp ResponseObject, history []Message) {
+	if cfg.ResponseStoreSize <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items[resp.ID] = &storedResponse{owner: owner, expires: time.Now().Add(cfg.ResponseStoreTTL.D()), response: resp, history: history}
+	s.order = append(s.order, resp.ID)
+	for len(s.items) > cfg.ResponseStoreSize && len(s.order) > 0 {
+		delete(s.items, s.order[0])
+		s.order = s.order[1:]
+	}
+	// 顺带清理已删除或过期的条目，避免 order 无限增长
+	for len(s.order) > 0 {
+		it, ok := s.items[s.order[0]]
+		if ok && time.Now().Before(it.expires) {
+			break
+		}
+		delete(s.items, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+func (s *responseStore) get(id, owner string) (*storedResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	it, ok := s.items[id]
+	if !ok || it.owner != owner || time.Now().After(it.expires) {
+		return nil, false
+	}
+	return it, true
+}
+
+func (s *responseStore) remove(id, owner string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	it, ok := s.items[id]
+	if !ok || it.owner != owner {
+		return false
+	}
+	delete(s.items, id)
+	return true
+}
+
+// cloneMessages 复制消息及其图片片段，避免并发请求共享存储中的切片
+func cloneMessages(msgs []Message) []Message {
+	out := make([]Message, len(msgs))
+	copy(out, msgs)
+	for i := range out {
+		if len(out[i].Parts) > 0 {
+			out[i].Parts = append([]ContentPart(nil), out[i].Parts...)
+		}
+	}
+	return out
+}
+
+// handleResponseByID GET/DELETE /v1/responses/{id}
+func handleResponseByID(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	apiKey := apiKeyFromContext(r.Context())
+	id := strings.TrimPrefix(r.URL.Path, "/v1/responses/")
+	switch r.Method {
+	case "GET":
+		it, ok := responses.get(id, apiKey.ID)
+		if !ok {
+			writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "response_not_found", fmt.Sprintf("Response with id '%s' not found.", id))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(it.response)
+	case "DELETE":
+		if !responses.remove(id, apiKey.ID) {
+			writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "response_not_found", fmt.Sprintf("Response with id '%s' not found.", id))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"id": id, "object": "response", "deleted": true})
+	default:
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "method_not_allowed", "Method "+r.Method+" not allowed.")
+	}
+}
+
+func handleResponses(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	debugLog("收到responses请求")
+	metrics.Requests.Add(1)
+
+	cfg := configFromContext(r.Context())
+	apiKey := apiKeyFromContext(r.Context())
+
+	var req ResponsesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		debugLog("JSON解析失败: %v", err)
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_json", "Invalid JSON: "+err.Error())
+		return
+	}
+	debugLog("请求解析成功 - 模型: %s, 流式: %v, previous_response_id: %s", req.Model, req.Stream, req.PreviousResponseID)
+
+	if !apiKey.allowsModel(req.Model) {
+		debugLog("密钥 %s 无权访问模型: %s", apiKey.ID, req.Model)
+		writeOpenAIError(w, http.StatusForbidden, "invalid_request_error", "model_not_allowed", "Model not allowed for this API key")
+		return
+	}
+	if len(req.Tools) > 0 && string(req.Tools) != "null" && string(req.Tools) != "[]" {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_tools", "tools are not supported on /v1/responses, use /v1/chat/completions")
+		return
+	}
+
+	// 续接之前的响应：取出其完整对话历史
+	var history []Message
+	if req.PreviousResponseID != "" {
+		prev, ok := responses.get(req.PreviousResponseID, apiKey.ID)
+		if !ok {
+			writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "previous_response_not_found",
+				fmt.Sprintf("Previous response with id '%s' not found.", req.PreviousResponseID))
+			return
+		}
+		history = cloneMessages(prev.history)
+	}
+	input, err := responsesInput(req.Input)
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_input", err.Error())
+		return
+	}
+	history = append(history, input...)
+
+	isThinking, isSearch := modelFeatures(req.Model)
+	if req.Reasoning != nil && req.Reasoning.Effort != "" {
+		if isThinking, err = parseEffort(req.Reasoning.Effort); err != nil {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_reasoning", err.Error())
+			return
+		}
+	}
+
+	messages := history
+	if req.Instructions != "" {
+		messages = append([]Message{{Role: "system", Content: req.Instructions}}, history...)
+	}
+	images, err := prepareImages(r.Context(), cfg, messages)
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", imageErrorCode(err), err.Error())
+		return
+	}
+	upstreamReq := newUpstreamRequest(cfg, messages, images, isThinking, isSearch)
+	if req.MaxOutputTokens > 0 {
+		upstreamReq.Params["max_tokens"] = req.MaxOutputTokens
+	}
+
+	resp := ResponseObject{
+		ID:        newResponseID("resp"),
+		Object:    "response",
+		CreatedAt: time.Now().Unix(),
+		Status:    "in_progress",
+		Model:     req.Model,
+		Output:    []any{},
+		Reasoning: req.Reasoning,
+		Store:     req.Store == nil || *req.Store,
+		Metadata:  req.Metadata,
+	}
+	if req.Instructions != "" {
+		resp.Instructions = &req.Instructions
+	}
+	if req.PreviousResponseID != "" {
+		resp.PreviousResponseID = &req.PreviousResponseID
+	}
+	if req.MaxOutputTokens > 0 {
+		resp.MaxOutputTokens = &req.MaxOutputTokens
+	}
+	if resp.Metadata == nil {
+		resp.Metadata = map[string]string{}
+	}
+
+	ctx, cancel := withUpstreamDeadlines(r.Context(), resolveDeadlines(cfg, req.Model, r.Header))
+	defer cancel()
+
+	limits := &turnLimits{contentBudget: newTokenBudget(req.MaxOutputTokens)}
+	out := &responsesOutput{w: w, cfg: cfg, resp: &resp, stream: req.Stream}
+	if req.Stream {
+		if _, ok := w.(http.Flusher); !ok {
+			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+	}
+	defer out.close()
+
+	err = runUpstream(ctx, cfg, upstreamReq, newAuthChain(cfg), thinking.ModeStrip, func(isReasoning bool, s string) bool {
+		kind, text, more := limits.accept(isReasoning, s)
+		out.delta(kind, text)
+		return more
+	})
+	if err != nil {
+		out.fail(ctx, err)
+		return
+	}
+	out.delta("text", limits.finish())
+	out.closeItem()
+
+	resp.Status = "completed"
+	if limits.contentBudget.exhausted() {
+		resp.Status = "incomplete"
+		resp.IncompleteDetails = &IncompleteDetails{Reason: "max_output_tokens"}
+	}
+	if resp.Store {
+		responses.put(cfg, apiKey.ID, resp, append(history, Message{Role: "assistant", Content: out.answer.String()}))
+	}
+
+	if req.Stream {
+		out.begin()
+		out.event("response."+resp.Status, map[string]any{"response": resp})
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+	metrics.Completed.Add(1)
+	debugLog("responses响应完成 (id=%s, status=%s)", resp.ID, resp.Status)
+}
+
+// responsesOutput 组装输出项；流式时同时发送对应的语义事件。
+// 与 Anthropic 接口一样，第一个事件在收到首个增量时才发送，上游在输出前失败时仍可返回HTTP错误
+type responsesOutput struct {
+	w      http.ResponseWriter
+	cfg    *Config
+	resp   *ResponseObject
+	stream bool
+	out    *sseWriter
+	seq    int
+
+	current string          // 当前打开的输出项类型（thinking/text），空表示没有
+	itemID  string          // 当前输出项ID
+	text    strings.Builder // 当前输出项的文本
+	answer  strings.Builder // 全部回答文本，存入对话历史
+}
+
+func (o *responsesOutput) begin() {
+	if !o.stream || o.out != nil {
+		return
+	}
+	o.w.Header().Set("Content-Type", "text/event-stream")
+	o.w.Header().Set("Cache-Control", "no-cache")
+	o.w.Header().Set("Connection", "keep-alive")
+	o.out = newSSEWriter(o.w, o.w.(http.Flusher), o.cfg.SSEHeartbeatInterval.D())
+	o.event("response.created", map[string]any{"response": o.resp})
+	o.event("response.in_progress", map[string]any{"response": o.resp})
+}
+
+// delta 追加一段内容，类型变化时结束上一个输出项并开始新项
+func (o *responsesOutput) delta(kind, text string) {
+	if text == "" {
+		return
+	}
+	o.begin()
+	o.open(kind)
+	o.text.WriteString(text)
+	index := len(o.resp.Output)
+	if kind == "thinking" {
+		o.event("response.reasoning_summary_text.delta", map[string]any{"item_id": o.itemID, "output_index": index, "summary_index": 0, "delta": text})
+		return
+	}
+	o.answer.WriteString(text)
+	o.event("response.output_text.delta", map[string]any{"item_id": o.itemID, "output_index": index, "content_index": 0, "delta": text, "logprobs": []any{}})
+}
+
+func (o *responsesOutput) open(kind string) {
+	if o.current == kind {
+		return
+	}
+	o.closeItem()
+	o.current = kind
+	o.text.Reset()
+	index := len(o.resp.Output)
+	if kind == "thinking" {
+		o.itemID = newResponseID("rs")
+		o.event("response.output_item.added", map[string]any{"output_index": index, "item": responseReasoningItem{Type: "reasoning", ID: o.itemID, Summary: []responseSummaryText{}}})
+		o.event("response.reasoning_summary_part.added", map[string]any{"item_id": o.itemID, "output_index": index, "summary_index": 0, "part": responseSummaryText{Type: "summary_text"}})
+		return
+	}
+	o.itemID = newResponseID("msg")
+	o.event("response.output_item.added", map[string]any{"output_index": index, "item": responseMessageItem{Type: "message", ID: o.itemID, Status: "in_progress", Role: "assistant", Content: []responseOutputText{}}})
+	o.event("response.content_part.added", map[string]any{"item_id": o.itemID, "output_index": index, "content_index": 0, "part": responseOutputText{Type: "output_text", Annotations: []any{}}})
+}
+
+// closeItem 结束当前输出项并加入响应
+func (o *responsesOutput) closeItem() {
+	if o.current == "" {
+		return
+	}
+	index := len(o.resp.Output)
+	text := o.text.String()
+	if o.current == "thinking" {
+		part := responseSummaryText{Type: "summary_text", Text: text}
+		item := responseReasoningItem{Type: "reasoning", ID: o.itemID, Summary: []responseSummaryText{part}}
+		o.event("response.reasoning_summary_text.done", map[string]any{"item_id": o.itemID, "output_index": index, "summary_index": 0, "text": text})
+		o.event("response.reasoning_summary_part.done", map[string]any{"item_id": o.itemID, "output_index": index, "summary_index": 0, "part": part})
+		o.event("response.output_item.done", map[string]any{"output_index": index, "item": item})
+		o.resp.Output = append(o.resp.Output, item)
+	} else {
+		part := responseOutputText{Type: "output_text", Text: text, Annotations: []any{}}
+		item := responseMessageItem{Type: "message", ID: o.itemID, Status: "completed", Role: "assistant", Content: []responseOutputText{part}}
+		o.event("response.output_text.done", map[string]any{"item_id": o.itemID, "output_index": index, "content_index": 0, "text": text, "logprobs": []any{}})
+		o.event("response.content_part.done", map[string]any{"item_id": o.itemID, "output_index": index, "content_index": 0, "part": part})
+		o.event("response.output_item.done", map[string]any{"output_index": index, "item": item})
+		o.resp.Output = append(o.resp.Output, item)
+	}
+	o.current = ""
+}
+
+// fail 上游失败：尚未开始输出时返回HTTP错误，否则发送 response.failed
+func (o *responsesOutput) fail(ctx context.Context, err error) {
+	if o.out == nil {
+		writeUpstreamFailure(ctx, o.w, o.cfg, err)
+		return
+	}
+	f, ok := describeUpstreamFailure(ctx, o.w, o.cfg, err)
+	if !ok {
+		return
+	}
+	code := f.Code
+	if code == "" {
+		code = "server_error"
+	}
+	o.closeItem()
+	o.resp.Status = "failed"
+	o.resp.Error = &ResponseError{Code: code, Message: f.Message}
+	o.event("response.failed", map[string]any{"response": o.resp})
+}
+
+// event 流式时发送一个带类型与序号的事件；非流式时忽略
+func (o *responsesOutput) event(name string, fields map[string]any) {
+	if o.out == nil {
+		return
+	}
+	fields["type"] = name
+	fields["sequence_number"] = o.seq
+	o.seq++
+	data, _ := json.Marshal(fields)
+	o.out.Event(name, data)
+}
+
+func (o *responsesOutput) close() {
+	if o.out != nil {
+		o.out.Close()
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 服务端会话：请求通过 X-Session-ID 请求头（或开启 session_from_user 后的 user 字段）指定会话ID，
+// 代理保存该会话的对话历史、上游 chat_id、所用凭证与各轮消息ID，客户端每轮只需发送新消息。
+// 后续轮次沿用 chat_id 与凭证，并以上一轮的上游消息ID作为 parent_id 接续消息链。
+// 会话只对创建它的密钥可见，空闲超过 session_ttl 后失效
+
+// SessionHeader 指定会话ID的请求头，响应中原样返回
+const SessionHeader = "X-Session-ID"
+
+var (
+	errSessionsDisabled = errors.New("sessions are disabled on this server")
+	errSessionsFull     = errors.New("too many active sessions on this server, please retry later")
+)
+
+// chatSession 一个会话的上游对话状态
+type chatSession struct {
+	lock chan struct{} // 同一会话的轮次串行执行
+	busy int           // 正在执行或排队等待的请求数（由 sessionStore.mu 保护），大于0时不会被淘汰
+
+	id      string
+	owner   string // 密钥ID
+	chatID  string // 上游 chat_id，首轮完成后确定
+	auth    *upstreamAuth
+	msgIDs  []string  // 当前 chat_id 下各轮的上游消息ID
+	history []Message // 不含本轮的完整对话（OpenAI 格式）
+	created time.Time
+	expires time.Time
+}
+
+// SessionInfo 会话信息（GET /v1/sessions/{id}）
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	Object     string    `json:"object"`
+	ChatID     string    `json:"chat_id"`
+	MessageIDs []string  `json:"message_ids"`
+	Messages   int       `json:"messages"`
+	Credential string    `json:"credential,omitempty"` // anonymous 或 account:名称
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+type sessionStore struct {
+	mu    sync.Mutex
+	items map[string]*chatSession // 键为 密钥ID + "/" + 会话ID
+}
+
+var sessions = &sessionStore{items: map[string]*chatSession{}}
+
+func sessionKey(owner, id string) string {
+	return owner + "/" + id
+}
+
+// open 取出或新建会话并占用它，直到调用 release；同一会话的并发请求排队等待。
+// 会话数已满且全部在使用中时返回 errSessionsFull
+func (s *sessionStore) open(ctx context.Context, cfg *Config, owner, id string) (*chatSession, error) {
+	if cfg.SessionMax <= 0 {
+		return nil, errSessionsDisabled
+	}
+	now := time.Now()
+	s.mu.Lock()
+	key := sessionKey(owner, id)
+	sess, ok := s.items[key]
+	if ok && now.After(sess.expires) {
+		delete(s.items, key)
+		ok = false
+	}
+	if !ok {
+		if !s.evict(cfg, now) {
+			s.mu.Unlock()
+			return nil, errSessionsFull
+		}
+		sess = &chatSession{lock: make(chan struct{}, 1), id: id, owner: owner, created: now}
+		s.items[key] = sess
+	}
+	sess.busy++
+	sess.expires = now.Add(cfg.SessionTTL.D())
+	s.mu.Unlock()
+
+	select {
+	case sess.lock <- struct{}{}:
+		return sess, nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		sess.busy--
+		s.mu.Unlock()
+		return nil, context.Cause(ctx)
+	}
+}
+
+// evict 为新会话腾出位置：清理过期会话，仍超过容量时淘汰最早过期的会话；
+// 使用中的会话不会被清理，腾不出位置时返回 false（需持有 s.mu）
+func (s *sessionStore) evict(cfg *Config, now time.Time) bool {
+	for key, sess := range s.items {
+		if sess.busy == 0 && now.After(sess.expires) {
+			delete(s.items, key)
+		}
+	}
+	for len(s.items) >= cfg.SessionMax {
+		oldest := ""
+		for key, sess := range s.items {
+			if sess.busy == 0 && (oldest == "" || sess.expires.Before(s.items[oldest].expires)) {
+				oldest = key
+			}
+		}
+		if oldest == "" {
+			return false
+		}
+		delete(s.items, oldest)
+	}
+	return true
+}
+
+func (s *sessionStore) get(owner, id string) (*chatSession, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.items[sessionKey(owner, id)]
+	if !ok || time.Now().After(sess.expires) {
+		return nil, false
+	}
+	return sess, true
+}
+
+func (s *sessionStore) remove(owner, id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := sessionKey(owner, id)
+	if _, ok := s.items[key]; !ok {
+		return false
+	}
+	delete(s.items, key)
+	return true
+}
+
+// release 结束本轮占用；刷新过期时间，使TTL从最后一轮结束时计算
+func (sess *chatSession) release(cfg *Config) {
+	sessions.mu.Lock()
+	sess.busy--
+	sess.expires = time.Now().Add(cfg.SessionTTL.D())
+	sessions.mu.Unlock()
+	<-sess.lock
+}
+
+// transcript 在历史之后拼接本轮的新消息
+func (sess *chatSession) transcript(msgs []Message) []Message {
+	out := make([]Message, 0, len(sess.history)+len(msgs))
+	out = append(out, sess.history...)
+	return append(out, msgs...)
+}
+
+// parentID 上一轮的上游消息ID，首轮为空
+func (sess *chatSession) parentID() string {
+	if len(sess.msgIDs) == 0 {
+		return ""
+	}
+	return sess.msgIDs[len(sess.msgIDs)-1]
+}
+
+// commit 本轮成功完成：记录新消息与回答，并沿用本轮的 chat_id、消息ID与凭证；
+// 本轮换了 chat_id（重放或修正时重新开始了上游对话）则消息链从本轮重新开始
+func (sess *chatSession) commit(msgs []Message, turn *sessionTurn, auth *upstreamAuth) {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	sess.history = append(sess.transcript(msgs), turn.message)
+	if turn.chatID != sess.chatID {
+		sess.msgIDs = nil
+	}
+	sess.chatID = turn.chatID
+	sess.msgIDs = append(sess.msgIDs, turn.msgID)
+	if auth != nil {
+		sess.auth = auth
+	}
+}
+
+func (sess *chatSession) info() SessionInfo {
+	info := SessionInfo{
+		ID:         sess.id,
+		Object:     "session",
+		ChatID:     sess.chatID,
+		MessageIDs: append([]string{}, sess.msgIDs...),
+		Messages:   len(sess.history),
+		CreatedAt:  sess.created,
+		ExpiresAt:  sess.expires,
+	}
+	if sess.auth != nil {
+		info.Credential = sess.auth.String()
+	}
+	return info
+}
+
+// requestSessionID 请求指定的会话ID：优先取请求头，开启 session_from_user 时也接受 user 字段
+func requestSessionID(cfg *Config, r *http.Request, req *OpenAIRequest) string {
+	if id := strings.TrimSpace(r.Header.Get(SessionHeader)); id != "" {
+		return id
+	}
+	if cfg.SessionFromUser {
+		return strings.TrimSpace(req.User)
+	}
+	return ""
+}
+
+// sessionTurn 本轮对话的结果，由响应处理函数在回答完整结束后通过 recordTurn 写入
+type sessionTurn struct {
+	message Message
+	chatID  string
+	msgID   string
+	done    bool
+}
+
+type sessionTurnKey struct{}
+
+func withSessionTurn(ctx context.Context, turn *sessionTurn) context.Context {
+	return context.WithValue(ctx, sessionTurnKey{}, turn)
+}
+
+// recordTurn 记录本轮的回答与实际使用的上游 chat_id 与消息ID；请求不属于会话时不做任何事
+func recordTurn(ctx context.Context, upstreamReq UpstreamRequest, message Message) {
+	turn, ok := ctx.Value(sessionTurnKey{}).(*sessionTurn)
+	if !ok {
+		return
+	}
+	turn.message = Message{Role: "assistant", Content: message.Content, ToolCalls: message.ToolCalls}
+	turn.chatID, turn.msgID = upstreamReq.ChatID, upstreamReq.ID
+	turn.done = true
+}
+
+// handleSession GET/DELETE /v1/sessions/{id}
+func handleSession(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	apiKey := apiKeyFromContext(r.Context())
+	id := strings.TrimPrefix(r.URL.Path, "/v1/sessions/")
+	switch r.Method {
+	case "GET":
+		sess, ok := sessions.get(apiKey.ID, id)
+		if !ok {
+			writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "session_not_found", "Session '"+id+"' not found.")
+			return
+		}
+		sessions.mu.Lock()
+		info := sess.info()
+		sessions.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	case "DELETE":
+		if !sessions.remove(apiKey.ID, id) {
+			writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "session_not_found", "Session '"+id+"' not found.")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"id": id, "object": "session", "deleted": true})
+	default:
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "method_not_allowed", "Method "+r.Method+" not allowed.")
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// resetSessions 清空全局会话存储
+func resetSessions(t *testing.T) {
+	t.Helper()
+	sessions.mu.Lock()
+	sessions.items = map[string]*chatSession{}
+	sessions.mu.Unlock()
+}
+
+func sessionConfig(max int) *Config {
+	return &Config{SessionMax: max, SessionTTL: Duration(time.Minute)}
+}
+
+func TestSessionOpenDisabled(t *testing.T) {
+	resetSessions(t)
+	if _, err := sessions.open(context.Background(), sessionConfig(0), "k", "s"); !errors.Is(err, errSessionsDisabled) {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+// 同一会话的请求串行执行：前一轮 release 之前，后一轮一直等待
+func TestSessionLocking(t *testing.T) {
+	resetSessions(t)
+	cfg := sessionConfig(10)
+	sess, err := sessions.open(context.Background(), cfg, "k", "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := sessions.open(ctx, cfg, "k", "s"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("会话占用中时 err = %v", err)
+	}
+
+	// 其他密钥的同名会话互不影响
+	other, err := sessions.open(context.Background(), cfg, "k2", "s")
+	if err != nil || other == sess {
+		t.Fatalf("其他密钥的会话: %v", err)
+	}
+	other.release(cfg)
+
+	got := make(chan *chatSession)
+	go func() {
+		s, _ := sessions.open(context.Background(), cfg, "k", "s")
+		got <- s
+	}()
+	select {
+	case <-got:
+		t.Fatal("release 之前不应取得会话")
+	case <-time.After(20 * time.Millisecond):
+	}
+	sess.release(cfg)
+	select {
+	case s := <-got:
+		if s != sess {
+			t.Fatal("应取得同一个会话")
+		}
+		s.release(cfg)
+	case <-time.After(time.Second):
+		t.Fatal("release 之后应取得会话")
+	}
+
+	sessions.mu.Lock()
+	busy := sess.busy
+	sessions.mu.Unlock()
+	if busy != 0 {
+		t.Fatalf("全部释放后 busy = %d", busy)
+	}
+}
+
+func TestSessionEviction(t *testing.T) {
+	resetSessions(t)
+	cfg := sessionConfig(2)
+	open := func(id string) *chatSession {
+		t.Helper()
+		sess, err := sessions.open(context.Background(), cfg, "k", id)
+		if err != nil {
+			t.Fatalf("open %s: %v", id, err)
+		}
+		return sess
+	}
+
+	a := open("a")
+	a.release(cfg)
+	time.Sleep(time.Millisecond)
+	open("b").release(cfg)
+	// 超过容量时淘汰最早过期的空闲会话
+	open("c").release(cfg)
+	if _, ok := sessions.get("k", "a"); ok {
+		t.Error("a 应被淘汰")
+	}
+	for _, id := range []string{"b", "c"} {
+		if _, ok := sessions.get("k", id); !ok {
+			t.Errorf("%s 不应被淘汰", id)
+		}
+	}
+
+	// 过期的会话不再可见，新建时被清理
+	sessions.mu.Lock()
+	sessions.items[sessionKey("k", "b")].expires = time.Now().Add(-time.Second)
+	sessions.mu.Unlock()
+	if _, ok := sessions.get("k", "b"); ok {
+		t.Error("过期的会话不应可见")
+	}
+	open("d").release(cfg)
+	if _, ok := sessions.get("k", "c"); !ok {
+		t.Error("清理过期会话后 c 不应被淘汰")
+	}
+}
+
+// 使用中的会话不会被淘汰，全部在使用中时拒绝新会话
+func TestSessionEvictionSkipsBusy(t *testing.T) {
+	resetSessions(t)
+	cfg := sessionConfig(1)
+	a, err := sessions.open(context.Background(), cfg, "k", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 即使已过期，使用中的会话也不会被清理
+	sessions.mu.Lock()
+	a.expires = time.Now().Add(-time.Second)
+	sessions.mu.Unlock()
+	if _, err := sessions.open(context.Background(), cfg, "k", "b"); !errors.Is(err, errSessionsFull) {
+		t.Fatalf("err = %v, want errSessionsFull", err)
+	}
+	a.release(cfg)
+
+	b, err := sessions.open(context.Background(), cfg, "k", "b")
+	if err != nil {
+		t.Fatalf("释放后 open: %v", err)
+	}
+	b.release(cfg)
+	if _, ok := sessions.get("k", "a"); ok {
+		t.Error("释放后 a 应被淘汰")
+	}
+}
+
+func TestSessionCommit(t *testing.T) {
+	resetSessions(t)
+	cfg := sessionConfig(10)
+	sess, err := sessions.open(context.Background(), cfg, "k", "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.release(cfg)
+
+	first := []Message{{Role: "user", Content: "hi"}}
+	if got := sess.transcript(first); len(got) != 1 {
+		t.Fatalf("首轮 transcript = %+v", got)
+	}
+	auth := &upstreamAuth{Token: "t", Account: "acc"}
+	sess.commit(first, &sessionTurn{message: Message{Role: "assistant", Content: "hello"}, chatID: "chat-1", msgID: "m1"}, auth)
+	if p := sess.parentID(); p != "m1" {
+		t.Errorf("parentID = %q, want m1", p)
+	}
+	// 凭证为 nil 时沿用原凭证
+	second := []Message{{Role: "user", Content: "again"}}
+	sess.commit(second, &sessionTurn{message: Message{Role: "assistant", Content: "ok"}, chatID: "chat-1", msgID: "m2"}, nil)
+	if ids := sess.info().MessageIDs; len(ids) != 2 || ids[1] != "m2" || sess.parentID() != "m2" {
+		t.Errorf("同一 chat_id 下消息链 = %v", ids)
+	}
+	// 换了 chat_id 时消息链重新开始
+	third := []Message{{Role: "user", Content: "more"}}
+	sess.commit(third, &sessionTurn{message: Message{Role: "assistant", Content: "done"}, chatID: "chat-2", msgID: "m3"}, nil)
+
+	got := sess.transcript([]Message{{Role: "user", Content: "last"}})
+	want := []string{"hi", "hello", "again", "ok", "more", "done", "last"}
+	if len(got) != len(want) {
+		t.Fatalf("transcript = %+v", got)
+	}
+	for i, m := range got {
+		if m.Content != want[i] {
+			t.Errorf("transcript[%d] = %q, want %q", i, m.Content, want[i])
+		}
+	}
+	info := sess.info()
+	if info.ChatID != "chat-2" || info.Messages != 6 || info.Credential != "account:acc" || len(info.MessageIDs) != 1 || info.MessageIDs[0] != "m3" {
+		t.Errorf("info = %+v", info)
+	}
+}
+
+func TestRequestSessionID(t *testing.T) {
+	r := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	req := &OpenAIRequest{User: "user-1"}
+	if id := requestSessionID(&Config{}, r, req); id != "" {
+		t.Errorf("未开启 session_from_user 时 = %q", id)
+	}
+	if id := requestSessionID(&Config{SessionFromUser: true}, r, req); id != "user-1" {
+		t.Errorf("session_from_user = %q", id)
+	}
+	r.Header.Set(SessionHeader, " s1 ")
+	if id := requestSessionID(&Config{SessionFromUser: true}, r, req); id != "s1" {
+		t.Errorf("请求头优先 = %q", id)
+	}
+}
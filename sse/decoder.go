@@ -0,0 +1,149 @@
+// Package sse 按 WHATWG HTML 规范解码 Server-Sent Events 流
+//
+// 与按行 bufio.Scanner 的做法相比，支持多行 data 字段、event/id/retry 字段、
+// CRLF/CR/LF 三种换行，并且单行长度不设上限（上游的大 edit_content 帧不会导致流中断）。
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event 一个完整的SSE事件
+type Event struct {
+	Event string        // 事件类型，未指定时为 "message"
+	Data  string        // 多个 data 字段以 "\n" 连接
+	ID    string        // 最近一次的 id 字段（跨事件保留）
+	Retry time.Duration // 本事件携带的 retry 字段，未携带时为0
+}
+
+// Decoder 从 io.Reader 中逐个读取事件
+type Decoder struct {
+	r       *bufio.Reader
+	line    []byte
+	started bool // 已处理流开头的BOM
+	skipLF  bool // 上一行以CR结束，若下一个字节是LF则属于同一个换行
+
+	// 当前事件的缓冲
+	event   string
+	data    strings.Builder
+	hasData bool
+	retry   time.Duration
+	lastID  string
+}
+
+// NewDecoder 创建解码器
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReaderSize(r, 32*1024)}
+}
+
+// Next 返回下一个事件；流正常结束时返回 io.EOF，读取失败时原样返回底层错误
+//
+// 规范要求丢弃流末尾未以空行结束的事件，这里为了兼容不规范的上游，
+// 末尾仍有已完整读取的 data 行时也会返回该事件。
+func (d *Decoder) Next() (*Event, error) {
+	for {
+		line, err := d.readLine()
+		if err != nil {
+			if err == io.EOF && d.hasData {
+				return d.dispatch(), nil
+			}
+			return nil, err
+		}
+		if len(line) == 0 {
+			if d.hasData {
+				return d.dispatch(), nil
+			}
+			d.reset()
+			continue
+		}
+		d.field(line)
+	}
+}
+
+// field 处理一行字段
+func (d *Decoder) field(line []byte) {
+	if line[0] == ':' {
+		// 注释行（如心跳 ": ping"）
+		return
+	}
+	name, value := line, []byte(nil)
+	if i := bytes.IndexByte(line, ':'); i >= 0 {
+		name, value = line[:i], line[i+1:]
+		value = bytes.TrimPrefix(value, []byte(" "))
+	}
+	switch string(name) {
+	case "event":
+		d.event = string(value)
+	case "data":
+		if d.hasData {
+			d.data.WriteByte('\n')
+		}
+		d.data.Write(value)
+		d.hasData = true
+	case "id":
+		if bytes.IndexByte(value, 0) < 0 {
+			d.lastID = string(value)
+		}
+	case "retry":
+		if ms, err := strconv.ParseUint(string(value), 10, 32); err == nil {
+			d.retry = time.Duration(ms) * time.Millisecond
+		}
+	}
+}
+
+func (d *Decoder) dispatch() *Event {
+	ev := &Event{Event: d.event, Data: d.data.String(), ID: d.lastID, Retry: d.retry}
+	if ev.Event == "" {
+		ev.Event = "message"
+	}
+	d.reset()
+	return ev
+}
+
+func (d *Decoder) reset() {
+	d.event = ""
+	d.data.Reset()
+	d.hasData = false
+	d.retry = 0
+}
+
+// readLine 读取一行（不含换行符），行长度不设上限；返回的切片在下次调用前有效
+// 流末尾没有换行符的残行按规范丢弃，返回 io.EOF
+func (d *Decoder) readLine() ([]byte, error) {
+	d.line = d.line[:0]
+	if !d.started {
+		d.started = true
+		if bom, _ := d.r.Peek(3); bytes.Equal(bom, []byte("\xef\xbb\xbf")) {
+			d.r.Discard(3)
+		}
+	}
+	for {
+		if _, err := d.r.Peek(1); err != nil {
+			return nil, err
+		}
+		buf, _ := d.r.Peek(d.r.Buffered())
+		if d.skipLF {
+			d.skipLF = false
+			if buf[0] == '\n' {
+				d.r.Discard(1)
+				continue
+			}
+		}
+		i := bytes.IndexAny(buf, "\r\n")
+		if i < 0 {
+			d.line = append(d.line, buf...)
+			d.r.Discard(len(buf))
+			continue
+		}
+		d.line = append(d.line, buf[:i]...)
+		d.r.Discard(i + 1)
+		// CR之后可能紧跟LF；不在此处阻塞等待下一个字节，留给下一次读取判断
+		d.skipLF = buf[i] == '\r'
+		return d.line, nil
+	}
+}
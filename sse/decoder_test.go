@@ -0,0 +1,97 @@
+package sse
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func decodeAll(t testing.TB, r io.Reader) []Event {
+	t.Helper()
+	dec := NewDecoder(r)
+	var events []Event
+	for {
+		ev, err := dec.Next()
+		if err == io.EOF {
+			return events
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		events = append(events, *ev)
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	long := strings.Repeat("x", 1<<20)
+	tests := []struct {
+		name  string
+		input string
+		want  []Event
+	}{
+		{"single", "data: hello\n\n", []Event{{Event: "message", Data: "hello"}}},
+		{"multi-line data", "data: a\ndata: b\n\n", []Event{{Event: "message", Data: "a\nb"}}},
+		{"crlf", "data: a\r\ndata: b\r\n\r\n", []Event{{Event: "message", Data: "a\nb"}}},
+		{"cr", "data: a\rdata: b\r\r", []Event{{Event: "message", Data: "a\nb"}}},
+		{"fields", "event: update\nid: 7\nretry: 1500\ndata: {}\n\n", []Event{{Event: "update", Data: "{}", ID: "7", Retry: 1500 * time.Millisecond}}},
+		{"id persists", "id: 1\ndata: a\n\ndata: b\n\n", []Event{{Event: "message", Data: "a", ID: "1"}, {Event: "message", Data: "b", ID: "1"}}},
+		{"comment and empty", ": ping\n\n\ndata: a\n\n", []Event{{Event: "message", Data: "a"}}},
+		{"no space", "data:a\n\n", []Event{{Event: "message", Data: "a"}}},
+		{"only one space stripped", "data:  a\n\n", []Event{{Event: "message", Data: " a"}}},
+		{"empty data", "data\n\n", []Event{{Event: "message", Data: ""}}},
+		{"invalid retry", "retry: 1s\ndata: a\n\n", []Event{{Event: "message", Data: "a"}}},
+		{"bom", "\xef\xbb\xbfdata: a\n\n", []Event{{Event: "message", Data: "a"}}},
+		{"no trailing blank line", "data: a\n", []Event{{Event: "message", Data: "a"}}},
+		{"partial line discarded", "data: a\n\ndata: b", []Event{{Event: "message", Data: "a"}}},
+		{"long line", "data: " + long + "\n\n", []Event{{Event: "message", Data: long}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := decodeAll(t, strings.NewReader(tt.input))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecoderReadError(t *testing.T) {
+	errBoom := errors.New("boom")
+	dec := NewDecoder(io.MultiReader(strings.NewReader("data: a\n\ndata: b"), iotest.ErrReader(errBoom)))
+	if ev, err := dec.Next(); err != nil || ev.Data != "a" {
+		t.Fatalf("first event = %v, %v", ev, err)
+	}
+	if _, err := dec.Next(); !errors.Is(err, errBoom) {
+		t.Fatalf("err = %v, want %v", err, errBoom)
+	}
+}
+
+// FuzzDecoder 解码结果不应依赖底层读取的分块方式，且数据中不会残留换行符CR
+func FuzzDecoder(f *testing.F) {
+	for _, seed := range []string{
+		"data: hello\n\n",
+		"data: a\r\ndata: b\r\n\r\n",
+		"data: a\rdata: b\r\r",
+		"event: x\nid: 1\nretry: 10\ndata: {}\n\n: ping\n\n",
+		"\xef\xbb\xbfdata:a\n\n",
+		`data: {"type":"chat:completion","data":{"phase":"answer","delta_content":"hi"}}` + "\n\n",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		whole := decodeAll(t, strings.NewReader(input))
+		split := decodeAll(t, iotest.OneByteReader(strings.NewReader(input)))
+		if !reflect.DeepEqual(whole, split) {
+			t.Fatalf("chunking changed result:\n whole=%q\n split=%q", whole, split)
+		}
+		for _, ev := range whole {
+			if strings.Contains(ev.Data, "\r") || strings.Contains(ev.Event, "\n") || ev.Event == "" {
+				t.Fatalf("malformed event %q", ev)
+			}
+		}
+	})
+}
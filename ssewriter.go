@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// sseHeartbeat SSE注释帧，客户端会忽略，只用于保持连接活跃
+const sseHeartbeat = ": ping\n\n"
+
+// sseWriter 单个流的唯一写协程：数据帧与心跳都经由它串行写出并立即flush
+// 上游长时间无输出（深度搜索、长思考）时按间隔发送心跳，避免前置代理关闭空闲连接
+type sseWriter struct {
+	frames chan []byte
+	done   chan struct{}
+}
+
+// newSSEWriter 启动写协程；interval 为0时不发送心跳
+func newSSEWriter(w io.Writer, flusher http.Flusher, interval time.Duration) *sseWriter {
+	s := &sseWriter{frames: make(chan []byte, 16), done: make(chan struct{})}
+	go s.run(w, flusher, interval)
+	return s
+}
+
+func (s *sseWriter) run(w io.Writer, flusher http.Flusher, interval time.Duration) {
+	defer close(s.done)
+	var tick <-chan time.Time
+	var ticker *time.Ticker
+	if interval > 0 {
+		ticker = time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	// 客户端断开后写入会失败，此时继续消费队列但不再写出，避免发送方阻塞
+	broken := false
+	write := func(b []byte) {
+		if broken {
+			return
+		}
+		if _, err := w.Write(b); err != nil {
+			debugLog("写入下游失败: %v", err)
+			broken = true
+			return
+		}
+		flusher.Flush()
+	}
+	for {
+		select {
+		case frame, ok := <-s.frames:
+			if !ok {
+				return
+			}
+			write(frame)
+			if ticker != nil {
+				// 只在没有数据的空闲期发送心跳
+				ticker.Reset(interval)
+			}
+		case <-tick:
+			debugLog("发送SSE心跳")
+			write([]byte(sseHeartbeat))
+		}
+	}
+}
+
+// Data 发送一个 data 帧
+func (s *sseWriter) Data(payload []byte) {
+	s.frames <- []byte(fmt.Sprintf("data: %s\n\n", payload))
+}
+
+// Event 发送一个带事件名的 data 帧（Anthropic 等按事件类型区分的流）
+func (s *sseWriter) Event(name string, payload []byte) {
+	s.frames <- []byte(fmt.Sprintf("event: %s\ndata: %s\n\n", name, payload))
+}
+
+// Close 等待已排队的帧写完后结束写协程；之后不能再发送
+func (s *sseWriter) Close() {
+	close(s.frames)
+	<-s.done
+}
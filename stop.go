@@ -0,0 +1,87 @@
+package main
+
+import "strings"
+
+// stopMatcher 在流式回答中查找停止序列；只缓存可能构成停止序列开头的尾部，其余内容立即输出
+type stopMatcher struct {
+	stops   []string
+	pending string
+	hit     string // 命中的停止序列
+}
+
+// newStopMatcher 没有停止序列时返回 nil（所有内容原样输出）
+func newStopMatcher(stops []string) *stopMatcher {
+	var valid []string
+	for _, s := range stops {
+		if s != "" {
+			valid = append(valid, s)
+		}
+	}
+	if len(valid) == 0 {
+		return nil
+	}
+	return &stopMatcher{stops: valid}
+}
+
+// Write 输入一段回答，返回可以输出的部分；命中停止序列时返回 true，之后的内容应丢弃
+func (m *stopMatcher) Write(s string) (string, bool) {
+	if m == nil {
+		return s, false
+	}
+	buf := m.pending + s
+	m.pending = ""
+	first := -1
+	for _, stop := range m.stops {
+		if i := strings.Index(buf, stop); i >= 0 && (first < 0 || i < first) {
+			first, m.hit = i, stop
+		}
+	}
+	if first >= 0 {
+		return buf[:first], true
+	}
+	keep := 0
+	for _, stop := range m.stops {
+		keep = max(keep, partialSuffix(buf, stop))
+	}
+	m.pending = buf[len(buf)-keep:]
+	return buf[:len(buf)-keep], false
+}
+
+// Flush 回答结束时输出缓存的残片
+func (m *stopMatcher) Flush() string {
+	if m == nil {
+		return ""
+	}
+	rest := m.pending
+	m.pending = ""
+	return rest
+}
+
+// turnLimits 一次回答的输出限制：思考预算、最大输出token与停止序列（供非 OpenAI 接口使用）
+type turnLimits struct {
+	thinkingBudget *tokenBudget
+	contentBudget  *tokenBudget
+	stop           *stopMatcher
+	stopped        bool
+}
+
+// accept 处理一段上游增量，返回内容块类型、可输出的文本，以及是否需要后续内容
+func (t *turnLimits) accept(isReasoning bool, s string) (string, string, bool) {
+	if isReasoning {
+		return "thinking", t.thinkingBudget.take(s), true
+	}
+	s, hit := t.stop.Write(s)
+	s = t.contentBudget.take(s)
+	if hit || t.contentBudget.exhausted() {
+		t.stopped = true
+	}
+	return "text", s, !t.stopped
+}
+
+// finish 上游结束后输出停止序列匹配器中缓存的残片
+func (t *turnLimits) finish() string {
+	if t.stopped {
+		return ""
+	}
+	return t.contentBudget.take(t.stop.Flush())
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// matchAll 依次写入各段，命中停止序列后不再写入；未命中时在最后 Flush
+func matchAll(stops []string, chunks []string) (string, string) {
+	m := newStopMatcher(stops)
+	var out strings.Builder
+	for _, c := range chunks {
+		s, hit := m.Write(c)
+		out.WriteString(s)
+		if hit {
+			return out.String(), m.hit
+		}
+	}
+	out.WriteString(m.Flush())
+	return out.String(), ""
+}
+
+var stopTests = []struct {
+	stops []string
+	input string
+	want  string
+	hit   string
+}{
+	{nil, "no stops at all", "no stops at all", ""},
+	{[]string{""}, "empty stop ignored", "empty stop ignored", ""},
+	{[]string{"\n\n"}, "line one\nline two\n\nline three", "line one\nline two", "\n\n"},
+	{[]string{"END"}, "almost EN but not quite E", "almost EN but not quite E", ""},
+	{[]string{"END"}, "ENDING right away", "", "END"},
+	{[]string{"STOP", "TOP"}, "a STOP b", "a ", "STOP"},
+	{[]string{"xyz", "b"}, "abcxyz", "a", "b"},
+	{[]string{"aab"}, "aaab", "a", "aab"},
+	{[]string{"你好"}, "说你你好吗", "说你", "你好"},
+}
+
+func TestStopMatcher(t *testing.T) {
+	for _, tt := range stopTests {
+		got, hit := matchAll(tt.stops, []string{tt.input})
+		if got != tt.want || hit != tt.hit {
+			t.Errorf("%q in %q: got %q (hit %q), want %q (hit %q)", tt.stops, tt.input, got, hit, tt.want, tt.hit)
+		}
+	}
+}
+
+// forEachSplit 把 input 按字节任意切成三段（段可以为空），逐一调用 f
+func forEachSplit(input string, f func(chunks []string)) {
+	for i := 0; i <= len(input); i++ {
+		for j := i; j <= len(input); j++ {
+			f([]string{input[:i], input[i:j], input[j:]})
+		}
+	}
+}
+
+// 停止序列被任意切分到多个chunk中时结果不变
+func TestStopMatcherChunkBoundaries(t *testing.T) {
+	for _, tt := range stopTests {
+		forEachSplit(tt.input, func(chunks []string) {
+			if got, hit := matchAll(tt.stops, chunks); got != tt.want || hit != tt.hit {
+				t.Fatalf("%q in %q split as %q: got %q (hit %q), want %q", tt.stops, tt.input, chunks, got, hit, tt.want)
+			}
+		})
+	}
+}
+
+// 可能构成停止序列开头的尾部先缓存，确定不是停止序列后再输出
+func TestStopMatcherHoldsPartialStop(t *testing.T) {
+	m := newStopMatcher([]string{"</answer>"})
+	if s, _ := m.Write("done </ans"); s != "done " {
+		t.Fatalf("Write = %q", s)
+	}
+	if s, _ := m.Write("wer? no"); s != "</answer? no" {
+		t.Fatalf("Write = %q", s)
+	}
+}
+
+func TestTurnLimits(t *testing.T) {
+	l := &turnLimits{thinkingBudget: newTokenBudget(2), contentBudget: newTokenBudget(100), stop: newStopMatcher([]string{"##"})}
+	if kind, s, more := l.accept(true, "think think think"); kind != "thinking" || s != "think th" || !more {
+		t.Fatalf("thinking = %q %q %v", kind, s, more)
+	}
+	if _, s, more := l.accept(false, "answer #"); s != "answer " || !more {
+		t.Fatalf("text = %q %v", s, more)
+	}
+	if _, s, more := l.accept(false, "# rest"); s != "" || more || !l.stopped {
+		t.Fatalf("命中停止序列后 = %q %v", s, more)
+	}
+	if rest := l.finish(); rest != "" {
+		t.Fatalf("停止后 finish = %q", rest)
+	}
+
+	// 内容预算用尽时停止，未停止时 finish 输出缓存的残片
+	l = &turnLimits{contentBudget: newTokenBudget(1), stop: newStopMatcher([]string{"##"})}
+	if _, s, more := l.accept(false, "abcdef"); s != "abcd" || more {
+		t.Fatalf("预算用尽 = %q %v", s, more)
+	}
+	l = &turnLimits{stop: newStopMatcher([]string{"##"})}
+	if _, s, _ := l.accept(false, "a#"); s != "a" {
+		t.Fatalf("残片 = %q", s)
+	}
+	if rest := l.finish(); rest != "#" {
+		t.Fatalf("finish = %q", rest)
+	}
+}
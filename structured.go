@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"z2api/jsonschema"
+)
+
+// 上游不支持 response_format：把格式要求注入系统提示词，回答结束后在本地校验，失败时要求模型修正
+
+// ResponseFormat OpenAI 的 response_format
+type ResponseFormat struct {
+	Type       string            `json:"type"` // text / json_object / json_schema
+	JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty"`
+}
+
+// JSONSchemaFormat response_format.json_schema
+type JSONSchemaFormat struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+// responseFormat 单个请求的结构化输出设置
+type responseFormat struct {
+	Type   string
+	Name   string
+	Desc   string
+	Raw    json.RawMessage    // 原始 schema，注入提示词用
+	Schema *jsonschema.Schema // json_object 或未给出 schema 时为 nil
+}
+
+// resolveResponseFormat 解析 response_format；未指定或为 text 时返回 nil
+func resolveResponseFormat(req *OpenAIRequest) (*responseFormat, error) {
+	rf := req.ResponseFormat
+	if rf == nil {
+		return nil, nil
+	}
+	switch rf.Type {
+	case "", "text":
+		return nil, nil
+	case "json_object":
+		return &responseFormat{Type: rf.Type}, nil
+	case "json_schema":
+	default:
+		return nil, fmt.Errorf("invalid response_format type %q (expected text, json_object or json_schema)", rf.Type)
+	}
+	if rf.JSONSchema == nil {
+		return nil, fmt.Errorf("response_format.json_schema is required when type is json_schema")
+	}
+	f := &responseFormat{Type: rf.Type, Name: rf.JSONSchema.Name, Desc: rf.JSONSchema.Description}
+	if raw := rf.JSONSchema.Schema; len(raw) > 0 && string(raw) != "null" {
+		schema, err := jsonschema.Compile(raw)
+		if err != nil {
+			return nil, fmt.Errorf("response_format.json_schema.schema: %v", err)
+		}
+		f.Raw, f.Schema = raw, schema
+	}
+	return f, nil
+}
+
+// systemPrompt 生成注入的输出格式说明
+func (f *responseFormat) systemPrompt() string {
+	var b strings.Builder
+	b.WriteString("# Response format\n\n")
+	if f.Raw == nil {
+		b.WriteString("Respond with a single valid JSON object and nothing else.")
+	} else {
+		b.WriteString("Respond with a single JSON value that conforms to the following JSON Schema and nothing else.")
+		if f.Name != "" {
+			fmt.Fprintf(&b, " The schema is named %q.", f.Name)
+		}
+		if f.Desc != "" {
+			b.WriteString(" " + f.Desc)
+		}
+		b.WriteString("\n<schema>\n")
+		b.Write(f.Raw)
+		b.WriteString("\n</schema>")
+	}
+	b.WriteString("\nDo not wrap the JSON in code fences and do not add any explanation before or after it.")
+	return b.String()
+}
+
+// check 去除代码围栏后解析并校验回答，返回可直接返回给客户端的JSON文本
+func (f *responseFormat) check(content string) (string, error) {
+	s := stripCodeFence(content)
+	if s == "" {
+		return "", fmt.Errorf("response is empty")
+	}
+	if !json.Valid([]byte(s)) {
+		return "", fmt.Errorf("response is not valid JSON")
+	}
+	if f.Schema != nil {
+		return s, f.Schema.ValidateJSON([]byte(s))
+	}
+	if s[0] != '{' {
+		return "", fmt.Errorf("response must be a JSON object")
+	}
+	return s, nil
+}
+
+// repairPrompt 校验失败后追加的用户消息
+func (f *responseFormat) repairPrompt(err error) string {
+	return fmt.Sprintf("Your previous response did not satisfy the required format: %v. "+
+		"Reply again with only the corrected JSON, without code fences or any other text.", err)
+}
+
+// stripCodeFence 去除模型常加的 ```json 代码围栏；本身已是合法JSON时原样返回
+func stripCodeFence(s string) string {
+	s = strings.TrimSpace(s)
+	if json.Valid([]byte(s)) {
+		return s
+	}
+	i := strings.Index(s, "```")
+	if i < 0 {
+		return s
+	}
+	rest := s[i+3:]
+	// 跳过语言标记（```json）
+	if nl := strings.IndexByte(rest, '\n'); nl >= 0 {
+		rest = rest[nl+1:]
+	} else {
+		rest = strings.TrimPrefix(rest, "json")
+	}
+	if j := strings.LastIndex(rest, "```"); j >= 0 {
+		rest = rest[:j]
+	}
+	return strings.TrimSpace(rest)
+}
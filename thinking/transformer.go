@@ -0,0 +1,165 @@
+// Package thinking 增量转换上游思考内容中的标签
+//
+// 上游思考内容形如：
+//
+//	<details type="reasoning" done="false">
+//	> 第一行
+//	> 第二行
+//	<summary>Thought for 3 seconds</summary>
+//	</details>
+//
+// 标签与引用前缀 "> " 可能被拆分到多个 delta 中。Transformer 是一个状态机，
+// 只缓存可能构成标签的残片，其余内容立即输出。
+package thinking
+
+import "strings"
+
+// 标签处理模式
+const (
+	ModeThink = "think" // <details> 转为 <think>
+	ModeStrip = "strip" // 去除 <details> 标签
+	ModeRaw   = "raw"   // 保留 <details> 标签
+)
+
+// maxTagLen 识别到标签名后等待 '>' 的最大长度，超过则按普通文本输出
+const maxTagLen = 1024
+
+// knownTags 需要处理的标签名（不含 '>' 与属性）
+var knownTags = []string{"<details", "</details", "<summary", "</summary", "</thinking", "<Full", "</Full"}
+
+// Transformer 单条思考内容流的转换状态，不能并发使用
+type Transformer struct {
+	mode      string
+	pending   string // 尚不能确定的残片（标签开头或行首的 '>'）
+	inSummary bool   // 位于 <summary> 内，内容整体丢弃
+	lineStart bool   // 下一个字符位于行首，需要去掉引用前缀
+	started   bool   // 已输出非空白内容，此前的空白被丢弃
+}
+
+// NewTransformer 创建转换器，mode 为 ModeThink、ModeStrip 或 ModeRaw
+func NewTransformer(mode string) *Transformer {
+	return &Transformer{mode: mode, lineStart: true}
+}
+
+// Write 输入一段上游内容，返回可以立即输出的转换结果（可能为空）
+func (t *Transformer) Write(s string) string {
+	buf := t.pending + s
+	t.pending = ""
+	var out strings.Builder
+	out.Grow(len(buf))
+	for i := 0; i < len(buf); {
+		if t.lineStart && !t.inSummary {
+			rest := buf[i:]
+			if strings.HasPrefix(rest, "> ") {
+				i += 2
+				t.lineStart = false
+				continue
+			}
+			if rest == ">" {
+				t.pending = rest
+				break
+			}
+			t.lineStart = false
+		}
+		switch buf[i] {
+		case '<':
+			n, ok := t.tag(buf[i:], &out)
+			if !ok {
+				t.pending = buf[i:]
+				return out.String()
+			}
+			i += n
+		case '\n':
+			t.emit(&out, "\n")
+			if !t.inSummary {
+				t.lineStart = true
+			}
+			i++
+		default:
+			j := strings.IndexAny(buf[i:], "<\n")
+			if j < 0 {
+				j = len(buf) - i
+			}
+			t.emit(&out, buf[i:i+j])
+			i += j
+		}
+	}
+	return out.String()
+}
+
+// Flush 思考内容结束时输出剩余的残片（未闭合的标签按普通文本处理）
+func (t *Transformer) Flush() string {
+	rest := t.pending
+	t.pending = ""
+	var out strings.Builder
+	t.emit(&out, rest)
+	return out.String()
+}
+
+// tag 处理以 '<' 开头的内容，返回消耗的字节数；需要更多输入才能判断时返回 false
+func (t *Transformer) tag(rest string, out *strings.Builder) (int, bool) {
+	for _, name := range knownTags {
+		if len(rest) <= len(name) {
+			if strings.HasPrefix(name, rest) {
+				return 0, false
+			}
+			continue
+		}
+		if !strings.HasPrefix(rest, name) {
+			continue
+		}
+		if c := rest[len(name)]; c != '>' && c != ' ' && c != '\t' && c != '\n' {
+			continue
+		}
+		end := strings.IndexByte(rest, '>')
+		if end < 0 {
+			if len(rest) < maxTagLen {
+				return 0, false
+			}
+			break
+		}
+		t.apply(name, rest[:end+1], out)
+		return end + 1, true
+	}
+	// 不是需要处理的标签，'<' 按普通文本输出
+	t.emit(out, "<")
+	return 1, true
+}
+
+func (t *Transformer) apply(name, tag string, out *strings.Builder) {
+	switch name {
+	case "<summary":
+		t.inSummary = true
+	case "</summary":
+		t.inSummary = false
+	case "<details":
+		switch t.mode {
+		case ModeThink:
+			t.emit(out, "<think>")
+		case ModeRaw:
+			t.emit(out, tag)
+		}
+	case "</details":
+		switch t.mode {
+		case ModeThink:
+			t.emit(out, "</think>")
+		case ModeRaw:
+			t.emit(out, tag)
+		}
+	}
+	// </thinking>、<Full>、</Full> 直接丢弃
+}
+
+func (t *Transformer) emit(out *strings.Builder, s string) {
+	if t.inSummary {
+		return
+	}
+	if !t.started {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if s == "" {
+			return
+		}
+		t.started = true
+	}
+	out.WriteString(s)
+}
@@ -0,0 +1,116 @@
+package thinking
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func transformAll(mode string, chunks []string) string {
+	t := NewTransformer(mode)
+	var out strings.Builder
+	for _, c := range chunks {
+		out.WriteString(t.Write(c))
+	}
+	out.WriteString(t.Flush())
+	return out.String()
+}
+
+const sample = "<details type=\"reasoning\" done=\"false\">\n> Let me think\n> about <b>it</b>.\n<summary>Thought for 2 seconds</summary>\n</details>"
+
+func TestTransformer(t *testing.T) {
+	tests := []struct {
+		mode  string
+		input string
+		want  string
+	}{
+		{ModeThink, sample, "<think>\nLet me think\nabout <b>it</b>.\n\n</think>"},
+		{ModeStrip, sample, "Let me think\nabout <b>it</b>.\n\n"},
+		{ModeRaw, sample, "<details type=\"reasoning\" done=\"false\">\nLet me think\nabout <b>it</b>.\n\n</details>"},
+		{ModeThink, "<Full>a</Full></thinking> b", "a b"},
+		{ModeThink, "a < b > c", "a < b > c"},
+		{ModeThink, "> quoted >  not a prefix", "quoted >  not a prefix"},
+		{ModeThink, "unclosed <details type=", "unclosed <details type="},
+		{ModeThink, "<detailsX>", "<detailsX>"},
+	}
+	for _, tt := range tests {
+		if got := transformAll(tt.mode, []string{tt.input}); got != tt.want {
+			t.Errorf("%s %q:\n got %q\nwant %q", tt.mode, tt.input, got, tt.want)
+		}
+	}
+}
+
+// 任意切分位置都应得到与整体输入相同的结果
+func TestTransformerChunkBoundaries(t *testing.T) {
+	for _, mode := range []string{ModeThink, ModeStrip, ModeRaw} {
+		want := transformAll(mode, []string{sample})
+		for i := 0; i <= len(sample); i++ {
+			for j := i; j <= len(sample); j++ {
+				got := transformAll(mode, []string{sample[:i], sample[i:j], sample[j:]})
+				if got != want {
+					t.Fatalf("%s split at %d,%d:\n got %q\nwant %q", mode, i, j, got, want)
+				}
+			}
+		}
+	}
+}
+
+// legacyTransform 原先按 delta 逐段执行的正则实现，仅用于基准对比
+func legacyTransform(mode, s string) string {
+	s = regexp.MustCompile(`(?s)<summary>.*?</summary>`).ReplaceAllString(s, "")
+	s = strings.ReplaceAll(s, "</thinking>", "")
+	s = strings.ReplaceAll(s, "<Full>", "")
+	s = strings.ReplaceAll(s, "</Full>", "")
+	s = strings.TrimSpace(s)
+	switch mode {
+	case "think":
+		s = regexp.MustCompile(`<details[^>]*>`).ReplaceAllString(s, "<think>")
+		s = strings.ReplaceAll(s, "</details>", "</think>")
+	case "strip":
+		s = regexp.MustCompile(`<details[^>]*>`).ReplaceAllString(s, "")
+		s = strings.ReplaceAll(s, "</details>", "")
+	}
+	s = strings.TrimPrefix(s, "> ")
+	s = strings.ReplaceAll(s, "\n> ", "\n")
+	return strings.TrimSpace(s)
+}
+
+// benchDeltas 模拟上游的思考内容流：每个 delta 只有几个字符
+func benchDeltas() []string {
+	var b strings.Builder
+	b.WriteString("<details type=\"reasoning\" done=\"false\">\n")
+	for i := 0; i < 200; i++ {
+		b.WriteString("> The user is asking about something, let me consider it carefully.\n")
+	}
+	b.WriteString("<summary>Thought for 12 seconds</summary>\n</details>")
+	s := b.String()
+	var deltas []string
+	for len(s) > 0 {
+		n := min(6, len(s))
+		deltas = append(deltas, s[:n])
+		s = s[n:]
+	}
+	return deltas
+}
+
+func BenchmarkTransformer(b *testing.B) {
+	deltas := benchDeltas()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		t := NewTransformer(ModeThink)
+		for _, d := range deltas {
+			t.Write(d)
+		}
+		t.Flush()
+	}
+}
+
+func BenchmarkLegacyRegex(b *testing.B) {
+	deltas := benchDeltas()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, d := range deltas {
+			legacyTransform(ModeThink, d)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// upstreamDeadlines 单个请求的上游超时设置
+type upstreamDeadlines struct {
+	Connect   time.Duration // 建立连接
+	FirstByte time.Duration // 从发出请求到收到首个响应字节
+	Idle      time.Duration // SSE帧之间的最大间隔
+	Total     time.Duration // 整个请求（含重试与重放）的总时长
+}
+
+// timeoutError 上游超时错误，Code 用于返回给客户端
+type timeoutError struct {
+	Code  string
+	Limit time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%s after %v", e.Code, e.Limit)
+}
+
+// asTimeout 判断错误是否为上游超时
+func asTimeout(err error) (*timeoutError, bool) {
+	var te *timeoutError
+	ok := errors.As(err, &te)
+	return te, ok
+}
+
+// clientGone 判断请求是否因客户端断开而取消（总超时不算）
+func clientGone(ctx context.Context) bool {
+	if ctx.Err() == nil {
+		return false
+	}
+	_, isTimeout := asTimeout(context.Cause(ctx))
+	return !isTimeout
+}
+
+// 客户端可通过以下请求头缩短（不能延长）超时，取值如 "30s" 或秒数
+const (
+	HeaderTimeoutConnect   = "X-Timeout-Connect"
+	HeaderTimeoutFirstByte = "X-Timeout-First-Byte"
+	HeaderTimeoutIdle      = "X-Timeout-Idle"
+	HeaderTimeoutTotal     = "X-Timeout-Total"
+)
+
+// resolveDeadlines 合并配置、按模型的总时长与客户端请求头
+func resolveDeadlines(cfg *Config, model string, h http.Header) upstreamDeadlines {
+	d := upstreamDeadlines{
+		Connect:   cfg.UpstreamConnectTimeout.D(),
+		FirstByte: cfg.UpstreamFirstByteTimeout.D(),
+		Idle:      cfg.UpstreamIdleTimeout.D(),
+		Total:     cfg.UpstreamTotalTimeout.D(),
+	}
+	if t, ok := cfg.ModelTimeouts[model]; ok && t > 0 {
+		d.Total = t.D()
+	}
+	shorten := func(dst *time.Duration, header string) {
+		v := h.Get(header)
+		if v == "" {
+			return
+		}
+		var req Duration
+		if err := req.Set(v); err != nil || req <= 0 {
+			debugLog("忽略无效的超时请求头 %s: %q", header, v)
+			return
+		}
+		if *dst <= 0 || req.D() < *dst {
+			*dst = req.D()
+		}
+	}
+	shorten(&d.Connect, HeaderTimeoutConnect)
+	shorten(&d.FirstByte, HeaderTimeoutFirstByte)
+	shorten(&d.Idle, HeaderTimeoutIdle)
+	shorten(&d.Total, HeaderTimeoutTotal)
+	return d
+}
+
+type deadlinesKey struct{}
+
+// withUpstreamDeadlines 把超时设置写入上下文，并施加总时长限制
+func withUpstreamDeadlines(ctx context.Context, d upstreamDeadlines) (context.Context, context.CancelFunc) {
+	ctx = context.WithValue(ctx, deadlinesKey{}, d)
+	if d.Total <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, d.Total, &timeoutError{Code: "upstream_total_timeout", Limit: d.Total})
+}
+
+func deadlinesFromContext(ctx context.Context) upstreamDeadlines {
+	d, _ := ctx.Value(deadlinesKey{}).(upstreamDeadlines)
+	return d
+}
+
+// upstreamClient 上游共享客户端：不设整体超时，由各请求的连接/首字节/空闲/总时长分别控制
+var upstreamClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialer := &net.Dialer{KeepAlive: 30 * time.Second}
+			if d := deadlinesFromContext(ctx).Connect; d > 0 {
+				dialer.Timeout = d
+			}
+			conn, err := dialer.DialContext(ctx, network, addr)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && ctx.Err() == nil {
+				return nil, &timeoutError{Code: "upstream_connect_timeout", Limit: dialer.Timeout}
+			}
+			return conn, err
+		},
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// deadlineBody 包装上游响应体：首字节前使用首字节超时，之后每次读到数据都重置空闲计时
+type deadlineBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	idle   time.Duration
+	timer  *time.Timer
+	mu     sync.Mutex
+	first  bool
+}
+
+// startUpstreamDeadlines 为一次上游调用创建可按超时原因取消的上下文
+// 返回的 wrap 用于包装响应体；请求失败时应调用 cancel(nil)
+func startUpstreamDeadlines(ctx context.Context) (reqCtx context.Context, cancel context.CancelCauseFunc, wrap func(*http.Response) *http.Response) {
+	d := deadlinesFromContext(ctx)
+	reqCtx, cancel = context.WithCancelCause(ctx)
+	var timer *time.Timer
+	if d.FirstByte > 0 {
+		timer = time.AfterFunc(d.FirstByte, func() {
+			cancel(&timeoutError{Code: "upstream_first_byte_timeout", Limit: d.FirstByte})
+		})
+	}
+	wrap = func(resp *http.Response) *http.Response {
+		resp.Body = &deadlineBody{ReadCloser: resp.Body, ctx: reqCtx, cancel: cancel, idle: d.Idle, timer: timer}
+		return resp
+	}
+	return reqCtx, cancel, wrap
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.touch()
+	}
+	if err != nil && err != io.EOF {
+		// 读取失败时优先返回超时原因，便于区分超时与普通断连
+		if cause := context.Cause(b.ctx); cause != nil {
+			if _, ok := asTimeout(cause); ok {
+				return n, cause
+			}
+		}
+	}
+	return n, err
+}
+
+// touch 收到数据后切换/重置为空闲计时
+func (b *deadlineBody) touch() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.first {
+		b.first = true
+		if b.timer != nil {
+			b.timer.Stop()
+		}
+		if b.idle > 0 {
+			idle := b.idle
+			b.timer = time.AfterFunc(idle, func() {
+				b.cancel(&timeoutError{Code: "upstream_idle_timeout", Limit: idle})
+			})
+		} else {
+			b.timer = nil
+		}
+		return
+	}
+	if b.timer != nil {
+		b.timer.Reset(b.idle)
+	}
+}
+
+func (b *deadlineBody) Close() error {
+	b.mu.Lock()
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	b.mu.Unlock()
+	err := b.ReadCloser.Close()
+	b.cancel(nil)
+	return err
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 首字节与空闲超时以错误事件结束流，而不是伪装成正常结束
+func TestStreamDeadlines(t *testing.T) {
+	tests := []struct {
+		name      string
+		firstByte time.Duration
+		idle      time.Duration
+		send      string // 停顿前发送的内容
+		content   string
+		code      string
+	}{
+		{"首字节超时", 50 * time.Millisecond, 0, "", "", "upstream_first_byte_timeout"},
+		{"空闲超时", time.Minute, 50 * time.Millisecond, upstreamFrame("answer", "Hello", false), "Hello", "upstream_idle_timeout"},
+	}
+	for _, tt := range tests {
+		release := make(chan struct{})
+		srv, _ := fakeUpstream(t, func(n int, w http.ResponseWriter, f http.Flusher) {
+			fmt.Fprint(w, tt.send)
+			f.Flush()
+			<-release
+		})
+		cfg := testChatConfig(srv.URL, 1)
+		cfg.StreamRecoveryAttempts = 0
+		cfg.UpstreamFirstByteTimeout = Duration(tt.firstByte)
+		cfg.UpstreamIdleTimeout = Duration(tt.idle)
+
+		frames := streamChat(t, cfg)
+		close(release)
+		if got := streamContent(frames); got != tt.content {
+			t.Errorf("%s: content = %q", tt.name, got)
+		}
+		if len(frames) < 2 || frames[len(frames)-1] != "[DONE]" || !strings.Contains(frames[len(frames)-2], `"code":"`+tt.code+`"`) {
+			t.Errorf("%s: 应以错误事件结束，frames = %q", tt.name, frames)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// 匿名token复用策略
+const (
+	TokenPolicySingle     = "single"      // 每个token只用于一次对话（默认，避免共享记忆）
+	TokenPolicyReuse      = "reuse"       // 每个token最多用于 anon_token_max_uses 次对话
+	TokenPolicyUntilError = "until-error" // 一直复用，直到上游返回401/429等错误
+)
+
+// pooledToken 池中的匿名token
+type pooledToken struct {
+	value     string
+	uses      int
+	fetchedAt time.Time
+	expiresAt time.Time // 来自JWT的exp声明，零值表示未知
+}
+
+func newPooledToken(value string, uses int) *pooledToken {
+	return &pooledToken{value: value, uses: uses, fetchedAt: time.Now(), expiresAt: tokenExpiry(value)}
+}
+
+// TokenPoolStats 匿名token池统计
+type TokenPoolStats struct {
+	Policy      string `json:"policy"`
+	TargetSize  int    `json:"target_size"`
+	Available   int    `json:"available"`
+	Fetched     int64  `json:"fetched"`
+	FetchErrors int64  `json:"fetch_errors"`
+	Acquired    int64  `json:"acquired"`
+	Misses      int64  `json:"misses"` // 池为空时同步获取的次数
+	Evicted     int64  `json:"evicted"`
+	Refreshed   int64  `json:"refreshed"` // 临近过期被提前替换的数量
+	LastError   string `json:"last_error,omitempty"`
+}
+
+// TokenPool 匿名token池：后台预取并保持一定数量的可用token
+type TokenPool struct {
+	mu     sync.Mutex
+	tokens []*pooledToken
+	stats  TokenPoolStats
+	wake   chan struct{}
+	fetch  func(ctx context.Context) (string, error)
+}
+
+var anonPool = newTokenPool(getAnonymousToken)
+
+func newTokenPool(fetch func(ctx context.Context) (string, error)) *TokenPool {
+	return &TokenPool{wake: make(chan struct{}, 1), fetch: fetch}
+}
+
+// notify 唤醒后台补充协程
+func (p *TokenPool) notify() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run 后台补充协程：池中token不足时持续预取，失败时指数退避
+func (p *TokenPool) Run() {
+	backoff := time.Second
+	for {
+		cfg := getConfig()
+		p.pruneExpiring(cfg.TokenRefreshMargin.D())
+		if !cfg.AnonTokenEnabled || p.Available() >= cfg.AnonPoolSize {
+			select {
+			case <-p.wake:
+			case <-time.After(30 * time.Second):
+			}
+			continue
+		}
+
+		t, err := p.fetch(context.Background())
+		p.mu.Lock()
+		if err != nil {
+			p.stats.FetchErrors++
+			p.stats.LastError = err.Error()
+			p.mu.Unlock()
+			debugLog("预取匿名token失败，%v后重试: %v", backoff, err)
+			time.Sleep(backoff)
+			backoff = min(backoff*2, time.Minute)
+			continue
+		}
+		p.stats.Fetched++
+		p.stats.LastError = ""
+		p.tokens = append(p.tokens, newPooledToken(t, 0))
+		p.mu.Unlock()
+		backoff = time.Second
+	}
+}
+
+// Available 当前池中可用token数量
+func (p *TokenPool) Available() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.tokens)
+}
+
+// Acquire 按配置的复用策略取出一个token；池为空时同步获取（随请求取消而中止）
+func (p *TokenPool) Acquire(ctx context.Context, cfg *Config) (string, error) {
+	defer p.notify()
+	p.pruneExpiring(cfg.TokenRefreshMargin.D())
+
+	p.mu.Lock()
+	if len(p.tokens) > 0 {
+		t := p.tokens[0]
+		t.uses++
+		p.stats.Acquired++
+		switch cfg.AnonTokenPolicy {
+		case TokenPolicyReuse:
+			if t.uses >= cfg.AnonTokenMaxUses {
+				p.tokens = p.tokens[1:]
+			} else {
+				// 轮转到队尾，使多个token均匀分担请求
+				p.tokens = append(p.tokens[1:], t)
+			}
+		case TokenPolicyUntilError:
+			p.tokens = append(p.tokens[1:], t)
+		default:
+			p.tokens = p.tokens[1:]
+		}
+		p.mu.Unlock()
+		return t.value, nil
+	}
+	p.stats.Misses++
+	p.mu.Unlock()
+
+	t, err := p.fetch(ctx)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.stats.FetchErrors++
+		p.stats.LastError = err.Error()
+		return "", err
+	}
+	p.stats.Fetched++
+	p.stats.Acquired++
+	if cfg.AnonTokenPolicy != TokenPolicySingle && cfg.AnonTokenMaxUses != 1 {
+		p.tokens = append(p.tokens, newPooledToken(t, 1))
+	}
+	return t, nil
+}
+
+// pruneExpiring 移除即将过期的token，由后台协程补充新token
+func (p *TokenPool) pruneExpiring(margin time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	kept := p.tokens[:0]
+	for _, t := range p.tokens {
+		if expiresWithin(t.expiresAt, margin) {
+			p.stats.Refreshed++
+			debugLog("匿名token即将过期，提前替换: %s (exp=%s)", maskKey(t.value), t.expiresAt.Format(time.RFC3339))
+			continue
+		}
+		kept = append(kept, t)
+	}
+	p.tokens = kept
+}
+
+// Tokens 返回池中token的身份信息（已脱敏）
+func (p *TokenPool) Tokens() []TokenInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	list := make([]TokenInfo, 0, len(p.tokens))
+	for _, t := range p.tokens {
+		list = append(list, inspectToken("anonymous", t.value))
+	}
+	return list
+}
+
+// Evict 上游拒绝该token（401/429或错误帧）时将其移出池
+func (p *TokenPool) Evict(token string, reason string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, t := range p.tokens {
+		if t.value == token {
+			p.tokens = append(p.tokens[:i:i], p.tokens[i+1:]...)
+			p.stats.Evicted++
+			debugLog("匿名token已淘汰 (%s): %s", reason, maskKey(token))
+			p.notify()
+			return
+		}
+	}
+}
+
+// Stats 返回统计快照
+func (p *TokenPool) Stats(cfg *Config) TokenPoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.stats
+	s.Policy = cfg.AnonTokenPolicy
+	s.TargetSize = cfg.AnonPoolSize
+	s.Available = len(p.tokens)
+	return s
+}
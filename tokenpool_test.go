@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// countingPool 每次获取返回新的 t1、t2……
+func countingPool() *TokenPool {
+	n := 0
+	return newTokenPool(func(ctx context.Context) (string, error) {
+		n++
+		return fmt.Sprintf("t%d", n), nil
+	})
+}
+
+func acquireN(t *testing.T, p *TokenPool, cfg *Config, n int) string {
+	t.Helper()
+	got := make([]string, n)
+	for i := range got {
+		tok, err := p.Acquire(context.Background(), cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[i] = tok
+	}
+	return strings.Join(got, ",")
+}
+
+func TestTokenPoolPolicies(t *testing.T) {
+	tests := []struct {
+		policy  string
+		maxUses int
+		want    string
+	}{
+		{TokenPolicySingle, 0, "t1,t2,t3,t4"},
+		{TokenPolicyReuse, 2, "t1,t1,t2,t2"},
+		{TokenPolicyReuse, 1, "t1,t2,t3,t4"},
+		{TokenPolicyUntilError, 0, "t1,t1,t1,t1"},
+	}
+	for _, tt := range tests {
+		cfg := &Config{AnonTokenPolicy: tt.policy, AnonTokenMaxUses: tt.maxUses}
+		if got := acquireN(t, countingPool(), cfg, 4); got != tt.want {
+			t.Errorf("%s (max_uses=%d): got %s, want %s", tt.policy, tt.maxUses, got, tt.want)
+		}
+	}
+}
+
+// 预取的token按顺序轮转使用，reuse 用满次数后移出池
+func TestTokenPoolReuseRotation(t *testing.T) {
+	p := countingPool()
+	p.tokens = []*pooledToken{newPooledToken("a", 0), newPooledToken("b", 0)}
+	cfg := &Config{AnonTokenPolicy: TokenPolicyReuse, AnonTokenMaxUses: 2}
+	if got := acquireN(t, p, cfg, 5); got != "a,b,a,b,t1" {
+		t.Errorf("got %s", got)
+	}
+	if s := p.Stats(cfg); s.Acquired != 5 || s.Misses != 1 || s.Fetched != 1 || s.Available != 1 {
+		t.Errorf("stats = %+v", s)
+	}
+}
+
+// until-error 一直复用同一个token，被上游拒绝后淘汰并换新token
+func TestTokenPoolEvict(t *testing.T) {
+	p := countingPool()
+	cfg := &Config{AnonTokenPolicy: TokenPolicyUntilError}
+	if got := acquireN(t, p, cfg, 2); got != "t1,t1" {
+		t.Fatalf("got %s", got)
+	}
+	p.Evict("t1", "401")
+	p.Evict("unknown", "401")
+	if got := acquireN(t, p, cfg, 2); got != "t2,t2" {
+		t.Errorf("淘汰后 got %s", got)
+	}
+	if s := p.Stats(cfg); s.Evicted != 1 || s.Available != 1 {
+		t.Errorf("stats = %+v", s)
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// 上游不支持原生工具调用：把工具定义注入系统提示词，再从回答中解析 <tool_call> 块
+
+// Tool 工具定义（目前只有 function 一种）
+type Tool struct {
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+}
+
+// ToolFunction 函数定义
+type ToolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+// ToolCall assistant 消息中的工具调用
+type ToolCall struct {
+	ID       string           `json:"id"`
+	Type     string           `json:"type"`
+	Function ToolCallFunction `json:"function"`
+}
+
+// ToolCallFunction 被调用的函数及其参数（JSON字符串）
+type ToolCallFunction struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// ToolCallDelta 流式 chunk 中的工具调用，index 标识第几个调用
+type ToolCallDelta struct {
+	Index int `json:"index"`
+	ToolCall
+}
+
+const (
+	toolCallOpen      = "<tool_call>"
+	toolCallClose     = "</tool_call>"
+	toolResponseOpen  = "<tool_response>"
+	toolResponseClose = "</tool_response>"
+)
+
+// toolOptions 单个请求的工具设置
+type toolOptions struct {
+	Tools    []Tool
+	Required bool   // tool_choice=required 或指定了函数
+	Forced   string // tool_choice 指定的函数名
+	Parallel bool   // 是否允许一次返回多个调用
+}
+
+// resolveTools 解析 tools / tool_choice / parallel_tool_calls；未提供工具或 tool_choice=none 时返回 nil
+func resolveTools(req *OpenAIRequest) (*toolOptions, error) {
+	if len(req.Tools) == 0 {
+		return nil, nil
+	}
+	for _, t := range req.Tools {
+		if t.Type != "function" || t.Function.Name == "" {
+			return nil, fmt.Errorf("unsupported tool: only function tools with a name are supported")
+		}
+	}
+	opts := &toolOptions{Tools: req.Tools, Parallel: req.ParallelToolCalls == nil || *req.ParallelToolCalls}
+	if len(req.ToolChoice) == 0 || string(req.ToolChoice) == "null" {
+		return opts, nil
+	}
+	var mode string
+	if err := json.Unmarshal(req.ToolChoice, &mode); err == nil {
+		switch mode {
+		case "auto":
+		case "none":
+			return nil, nil
+		case "required":
+			opts.Required = true
+		default:
+			return nil, fmt.Errorf("invalid tool_choice %q", mode)
+		}
+		return opts, nil
+	}
+	var named struct {
+		Type     string `json:"type"`
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(req.ToolChoice, &named); err != nil || named.Type != "function" {
+		return nil, fmt.Errorf("invalid tool_choice")
+	}
+	for _, t := range req.Tools {
+		if t.Function.Name == named.Function.Name {
+			opts.Tools = []Tool{t}
+			opts.Required = true
+			opts.Forced = t.Function.Name
+			return opts, nil
+		}
+	}
+	return nil, fmt.Errorf("tool_choice function %q is not in tools", named.Function.Name)
+}
+
+// systemPrompt 生成注入的工具说明
+func (o *toolOptions) systemPrompt() string {
+	var b strings.Builder
+	b.WriteString("# Tools\n\nYou may call one or more functions to assist with the user query.\n\n")
+	b.WriteString("Function signatures are provided within <tools></tools> XML tags:\n<tools>\n")
+	for _, t := range o.Tools {
+		line, _ := json.Marshal(t)
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	b.WriteString("</tools>\n\n")
+	b.WriteString("To call a function, respond with a JSON object containing the function name and arguments within " + toolCallOpen + toolCallClose + " XML tags:\n")
+	b.WriteString(toolCallOpen + "\n{\"name\": <function-name>, \"arguments\": <args-json-object>}\n" + toolCallClose + "\n\n")
+	b.WriteString("Function results will be provided within " + toolResponseOpen + toolResponseClose + " XML tags. ")
+	switch {
+	case o.Forced != "":
+		fmt.Fprintf(&b, "You must call the function %q in this response.", o.Forced)
+	case o.Required:
+		b.WriteString("You must call at least one function in this response.")
+	default:
+		b.WriteString("Only call a function when it is needed; otherwise answer directly.")
+	}
+	if !o.Parallel {
+		b.WriteString(" Call at most one function per response.")
+	}
+	return b.String()
+}
+
+// upstreamMessages 把 OpenAI 消息转换为上游可接受的纯文本消息：
+// 注入工具说明，assistant 的 tool_calls 还原为 <tool_call> 块，连续的 tool 结果合并为一条 user 消息
+func upstreamMessages(msgs []Message, opts *toolOptions) []Message {
+	names := map[string]string{} // tool_call_id -> 函数名
+	var out []Message
+	for _, m := range msgs {
+		switch {
+		case m.Role == "tool":
+			name := m.Name
+			if name == "" {
+				name = names[m.ToolCallID]
+			}
+			block := fmt.Sprintf("%s\n{\"name\": %q, \"content\": %s}\n%s", toolResponseOpen, name, jsonString(m.Content), toolResponseClose)
+			if n := len(out); n > 0 && out[n-1].Role == "user" && strings.HasSuffix(out[n-1].Content, toolResponseClose) {
+				out[n-1].Content += "\n" + block
+				continue
+			}
+			out = append(out, Message{Role: "user", Content: block})
+		case m.Role == "assistant" && len(m.ToolCalls) > 0:
+			var b strings.Builder
+			b.WriteString(m.Content)
+			for _, c := range m.ToolCalls {
+				names[c.ID] = c.Function.Name
+				args := strings.TrimSpace(c.Function.Arguments)
+				if !json.Valid([]byte(args)) {
+					args = jsonString(args)
+				}
+				if b.Len() > 0 {
+					b.WriteByte('\n')
+				}
+				fmt.Fprintf(&b, "%s\n{\"name\": %q, \"arguments\": %s}\n%s", toolCallOpen, c.Function.Name, args, toolCallClose)
+			}
+			out = append(out, Message{Role: "assistant", Content: b.String()})
+		default:
+			out = append(out, Message{Role: m.Role, Content: m.Content, Parts: m.Parts})
+		}
+	}
+	if opts == nil {
+		return out
+	}
+	return appendSystemPrompt(out, opts.systemPrompt())
+}
+
+// appendSystemPrompt 把说明追加到第一条 system 消息，没有时在开头插入一条
+func appendSystemPrompt(msgs []Message, prompt string) []Message {
+	if len(msgs) > 0 && msgs[0].Role == "system" {
+		msgs[0].Content = msgs[0].Content + "\n\n" + prompt
+		return msgs
+	}
+	return append([]Message{{Role: "system", Content: prompt}}, msgs...)
+}
+
+func jsonString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// newToolCallID 生成 call_ 前缀的调用ID
+func newToolCallID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "call_" + hex.EncodeToString(b)
+}
+
+// toolCallParser 从回答流中分离文本与 <tool_call> 块，只缓存可能是标签的残片与未闭合的调用
+type toolCallParser struct {
+	opts    *toolOptions
+	pending string
+	inCall  bool
+	calls   int
+	space   string // 上一个调用之后暂存的空白，随后是调用或回答结束时丢弃
+	hasText bool   // 上一个调用之后是否已输出非空白文本
+}
+
+func newToolCallParser(opts *toolOptions) *toolCallParser {
+	if opts == nil {
+		return nil
+	}
+	return &toolCallParser{opts: opts}
+}
+
+// Write 输入一段回答内容，返回可以输出的文本与解析出的完整调用
+func (p *toolCallParser) Write(s string) (string, []ToolCall) {
+	p.pending += s
+	var text strings.Builder
+	var calls []ToolCall
+	for {
+		if !p.inCall {
+			i := strings.Index(p.pending, toolCallOpen)
+			if i < 0 {
+				keep := partialSuffix(p.pending, toolCallOpen)
+				p.text(&text, p.pending[:len(p.pending)-keep])
+				p.pending = p.pending[len(p.pending)-keep:]
+				break
+			}
+			p.text(&text, p.pending[:i])
+			p.pending = p.pending[i+len(toolCallOpen):]
+			p.inCall = true
+		}
+		j := strings.Index(p.pending, toolCallClose)
+		if j < 0 {
+			break
+		}
+		body := p.pending[:j]
+		p.pending = p.pending[j+len(toolCallClose):]
+		p.inCall = false
+		if call, ok := p.parse(body); ok {
+			calls = append(calls, call...)
+			p.space, p.hasText = "", false
+		} else {
+			p.text(&text, toolCallOpen+body+toolCallClose)
+		}
+	}
+	return text.String(), calls
+}
+
+// Flush 回答结束时输出剩余内容；未闭合的调用若本身是完整JSON也视为调用
+func (p *toolCallParser) Flush() (string, []ToolCall) {
+	rest := p.pending
+	p.pending = ""
+	if p.inCall {
+		p.inCall = false
+		if call, ok := p.parse(rest); ok {
+			p.space = ""
+			return "", call
+		}
+		rest = toolCallOpen + rest
+	}
+	var text strings.Builder
+	p.text(&text, rest)
+	p.space = ""
+	return text.String(), nil
+}
+
+// parse 解析一个调用块；函数不在工具列表中或JSON无效时返回 false
+// 不允许并行调用时，第一个之后的调用被丢弃（返回空切片）
+func (p *toolCallParser) parse(body string) ([]ToolCall, bool) {
+	body = strings.TrimSpace(body)
+	body = strings.TrimPrefix(body, "```json")
+	body = strings.TrimPrefix(body, "```")
+	body = strings.TrimSuffix(body, "```")
+	var raw struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(body)), &raw); err != nil || !p.known(raw.Name) {
+		debugLog("无法解析的工具调用，按文本输出: %s", body)
+		return nil, false
+	}
+	if !p.opts.Parallel && p.calls > 0 {
+		debugLog("未启用并行工具调用，丢弃多余的调用: %s", raw.Name)
+		return nil, true
+	}
+	args := "{}"
+	if len(raw.Arguments) > 0 && string(raw.Arguments) != "null" {
+		var s string
+		if json.Unmarshal(raw.Arguments, &s) == nil {
+			args = s
+		} else {
+			var buf bytes.Buffer
+			if json.Compact(&buf, raw.Arguments) == nil {
+				args = buf.String()
+			}
+		}
+	}
+	p.calls++
+	return []ToolCall{{ID: newToolCallID(), Type: "function", Function: ToolCallFunction{Name: raw.Name, Arguments: args}}}, true
+}
+
+func (p *toolCallParser) known(name string) bool {
+	for _, t := range p.opts.Tools {
+		if t.Function.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// text 输出调用之外的文本；出现工具调用后，调用之间（及最后一个调用之后）只有空白的文本不再输出。
+// 空白先暂存，等到后面出现非空白文本才一起输出，因此结果与内容如何分段无关
+func (p *toolCallParser) text(b *strings.Builder, s string) {
+	if p.calls == 0 || p.hasText {
+		b.WriteString(s)
+		return
+	}
+	p.space += s
+	if strings.TrimSpace(p.space) != "" {
+		b.WriteString(p.space)
+		p.space, p.hasText = "", true
+	}
+}
+
+// partialSuffix 返回 s 结尾与 tag 开头重合的最大长度（不含整个 tag）
+func partialSuffix(s, tag string) int {
+	for k := min(len(s), len(tag)-1); k > 0; k-- {
+		if strings.HasSuffix(s, tag[:k]) {
+			return k
+		}
+	}
+	return 0
+}
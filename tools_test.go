@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+var testTools = []Tool{
+	{Type: "function", Function: ToolFunction{Name: "get_weather"}},
+	{Type: "function", Function: ToolFunction{Name: "search"}},
+}
+
+// parseAll 依次写入各段并在最后 Flush，返回拼接的文本与 name(arguments) 形式的调用
+func parseAll(opts *toolOptions, chunks []string) (string, []string) {
+	p := newToolCallParser(opts)
+	var text strings.Builder
+	var calls []string
+	collect := func(s string, cs []ToolCall) {
+		text.WriteString(s)
+		for _, c := range cs {
+			calls = append(calls, c.Function.Name+"("+c.Function.Arguments+")")
+		}
+	}
+	for _, c := range chunks {
+		collect(p.Write(c))
+	}
+	collect(p.Flush())
+	return text.String(), calls
+}
+
+var toolCallTests = []struct {
+	name     string
+	parallel bool
+	input    string
+	text     string
+	calls    []string
+}{
+	{"纯文本", true, "Hello, world", "Hello, world", nil},
+	{"单个调用", true, `<tool_call>{"name":"get_weather","arguments":{"city":"Paris"}}</tool_call>`, "", []string{`get_weather({"city":"Paris"})`}},
+	{"文本与调用交错", true, `Let me check. <tool_call>{"name":"get_weather","arguments":{"city":"Paris"}}</tool_call> and <tool_call>{"name":"search","arguments":{"q":"news"}}</tool_call> done`,
+		"Let me check.  and  done", []string{`get_weather({"city":"Paris"})`, `search({"q":"news"})`}},
+	{"调用之间的空白不输出", true, "Sure.<tool_call>{\"name\":\"search\"}</tool_call>\n\n<tool_call>{\"name\":\"search\"}</tool_call>\n",
+		"Sure.", []string{"search({})", "search({})"}},
+	{"字符串形式的参数", true, `<tool_call>{"name":"search","arguments":"{\"q\":\"x\"}"}</tool_call>`, "", []string{`search({"q":"x"})`}},
+	{"代码块包裹", true, "<tool_call>\n```json\n{\"name\":\"search\",\"arguments\":{\"q\":1}}\n```\n</tool_call>", "", []string{`search({"q":1})`}},
+	{"未知函数按文本输出", true, `a <tool_call>{"name":"rm_rf"}</tool_call> b`, `a <tool_call>{"name":"rm_rf"}</tool_call> b`, nil},
+	{"无效JSON按文本输出", true, `a <tool_call>{"name":</tool_call> b`, `a <tool_call>{"name":</tool_call> b`, nil},
+	{"未闭合但JSON完整", true, `Checking <tool_call>{"name":"search","arguments":{}}`, "Checking ", []string{"search({})"}},
+	{"未闭合且JSON不完整", true, `Checking <tool_call>{"name":"sea`, `Checking <tool_call>{"name":"sea`, nil},
+	{"结尾是不完整的开始标签", true, "a < b <tool_", "a < b <tool_", nil},
+	{"相似但不是标签", true, "<tool_calls> <tool_cal>", "<tool_calls> <tool_cal>", nil},
+	{"未开启并行时丢弃多余调用", false, `x<tool_call>{"name":"search"}</tool_call><tool_call>{"name":"get_weather"}</tool_call>`, "x", []string{"search({})"}},
+}
+
+func TestToolCallParser(t *testing.T) {
+	for _, tt := range toolCallTests {
+		opts := &toolOptions{Tools: testTools, Parallel: tt.parallel}
+		text, calls := parseAll(opts, []string{tt.input})
+		if text != tt.text || strings.Join(calls, ";") != strings.Join(tt.calls, ";") {
+			t.Errorf("%s:\n got %q %q\nwant %q %q", tt.name, text, calls, tt.text, tt.calls)
+		}
+	}
+}
+
+// 在任意字节位置切分输入（包括标签内部）都应得到与整体输入相同的结果
+func TestToolCallParserChunkBoundaries(t *testing.T) {
+	for _, tt := range toolCallTests {
+		opts := &toolOptions{Tools: testTools, Parallel: tt.parallel}
+		forEachSplit(tt.input, func(chunks []string) {
+			text, calls := parseAll(opts, chunks)
+			if text != tt.text || strings.Join(calls, ";") != strings.Join(tt.calls, ";") {
+				t.Fatalf("%s split as %q:\n got %q %q\nwant %q %q", tt.name, chunks, text, calls, tt.text, tt.calls)
+			}
+		})
+	}
+}
+
+// 未闭合的标签残片在 Write 时被缓存，不会提前输出
+func TestToolCallParserHoldsPartialTag(t *testing.T) {
+	p := newToolCallParser(&toolOptions{Tools: testTools})
+	if text, _ := p.Write("Hi <tool"); text != "Hi " {
+		t.Fatalf("Write = %q, want %q", text, "Hi ")
+	}
+	if text, _ := p.Write("box"); text != "<toolbox" {
+		t.Fatalf("Write = %q, want %q", text, "<toolbox")
+	}
+}
+
+func TestPartialSuffix(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{"", 0},
+		{"abc", 0},
+		{"abc<", 1},
+		{"abc<tool_", 6},
+		{"<tool_call", 10},
+		{"<tool_call>", 0}, // 完整标签由 strings.Index 处理
+		{"<<", 1},
+		{"<tool_x", 0},
+		{"tool_call>", 0},
+	}
+	for _, tt := range tests {
+		if got := partialSuffix(tt.s, toolCallOpen); got != tt.want {
+			t.Errorf("partialSuffix(%q) = %d, want %d", tt.s, got, tt.want)
+		}
+	}
+}
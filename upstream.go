@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"z2api/sse"
+	"z2api/thinking"
+)
+
+// 与客户端API格式无关的上游对话驱动，供 OpenAI 以外的接口（Anthropic 等）复用：
+// 凭证轮换、输出前中断时的静默重放、思考内容标签转换都在这里完成，调用方只负责编码输出
+
+// upstreamStatusError 上游返回非200状态
+type upstreamStatusError struct {
+	Status string
+}
+
+func (e *upstreamStatusError) Error() string {
+	return "upstream status " + e.Status
+}
+
+// newUpstreamStatusError 关闭非200响应并转换为错误（debug模式下记录响应体）
+func newUpstreamStatusError(cfg *Config, resp *http.Response) error {
+	debugLog("上游返回错误状态: %d", resp.StatusCode)
+	if cfg.DebugMode {
+		body, _ := io.ReadAll(resp.Body)
+		debugLog("上游错误响应: %s", string(body))
+	}
+	resp.Body.Close()
+	return &upstreamStatusError{resp.Status}
+}
+
+// upstreamEmit 接收一段思考（reasoning=true）或回答内容；返回 false 表示调用方不再需要后续内容
+type upstreamEmit func(reasoning bool, s string) bool
+
+// runUpstream 执行一次上游对话，把增量交给 emit，直到上游结束或 emit 返回 false
+// 在输出任何内容前上游断开或返回错误帧时换凭证重放；已输出内容后上游断开视为正常结束，
+// 只有调用失败、超时或始终没有内容的错误才返回 error
+func runUpstream(ctx context.Context, cfg *Config, upstreamReq UpstreamRequest, chain *authChain, tagsMode string, emit upstreamEmit) error {
+	emitted := false
+	track := func(reasoning bool, s string) bool {
+		emitted = true
+		return emit(reasoning, s)
+	}
+	chatID := upstreamReq.ChatID
+	for recoveries := 0; ; recoveries++ {
+		if recoveries > 0 {
+			metrics.StreamRecoveries.Add(1)
+			log.Printf("上游在输出内容前中断，第%d次重放 (chat_id=%s)", recoveries, chatID)
+			upstreamReq.restartChat()
+			chain.allowFreshAnonymous()
+		}
+		resp, auth, err := callUpstreamWithFailover(ctx, cfg, upstreamReq, upstreamReq.ChatID, chain)
+		if err != nil {
+			debugLog("调用上游失败: %v", err)
+			return err
+		}
+
+		u := &upstreamReader{think: thinking.NewTransformer(tagsMode)}
+		done, errObj, readErr := u.read(resp.Body, track)
+		resp.Body.Close()
+		if done {
+			return nil
+		}
+		if clientGone(ctx) {
+			return context.Cause(ctx)
+		}
+		if errObj != nil {
+			debugLog("上游错误: code=%d, detail=%s", errObj.Code, errObj.Detail)
+			chain.fail(auth, fmt.Sprintf("上游错误 code=%d", errObj.Code))
+		}
+		if !emitted && recoveries < cfg.StreamRecoveryAttempts && ctx.Err() == nil {
+			continue
+		}
+		if _, ok := asTimeout(readErr); ok {
+			return readErr
+		}
+		if !emitted && errObj != nil {
+			return fmt.Errorf("upstream error code=%d: %s", errObj.Code, errObj.Detail)
+		}
+		if readErr != nil {
+			log.Printf("上游流异常结束 (chat_id=%s, 已输出内容: %v): %v", chatID, emitted, readErr)
+		}
+		return nil
+	}
+}
+
+// upstreamReader 把上游SSE事件转换为思考与回答增量，所有接口（含 /v1/chat/completions）共用
+type upstreamReader struct {
+	think             *thinking.Transformer
+	sentInitialAnswer bool // 是否已输出最初的 answer 片段（来自 EditContent）
+	events            int  // 已读取的SSE事件数
+}
+
+// read 读取上游SSE直到结束信号；返回 true 表示正常结束或调用方已停止
+func (u *upstreamReader) read(body io.Reader, emit upstreamEmit) (bool, *UpstreamError, error) {
+	dec := sse.NewDecoder(body)
+	for {
+		ev, err := dec.Next()
+		if err == io.EOF {
+			return false, nil, nil
+		}
+		if err != nil {
+			debugLog("读取上游SSE失败: %v", err)
+			return false, nil, err
+		}
+		u.events++
+		if ev.Data == "" {
+			continue
+		}
+		debugLog("收到SSE数据 (第%d个事件): %s", u.events, ev.Data)
+
+		var upstreamData UpstreamData
+		if err := json.Unmarshal([]byte(ev.Data), &upstreamData); err != nil {
+			debugLog("SSE数据解析失败: %v", err)
+			continue
+		}
+		if errObj := upstreamData.upstreamError(); errObj != nil {
+			return false, errObj, nil
+		}
+
+		data := upstreamData.Data
+		if data.Phase != "thinking" {
+			if s := u.think.Flush(); s != "" && !emit(true, s) {
+				return true, nil, nil
+			}
+		}
+		if !u.sentInitialAnswer && data.EditContent != "" && data.Phase == "answer" {
+			if _, answer, ok := strings.Cut(data.EditContent, "</details>"); ok && strings.TrimSpace(answer) != "" {
+				answer = strings.TrimLeft(answer, "\r\n")
+				u.sentInitialAnswer = true
+				if !emit(false, answer) {
+					return true, nil, nil
+				}
+			}
+		}
+		if data.DeltaContent != "" {
+			reasoning, s := data.Phase == "thinking", data.DeltaContent
+			if reasoning {
+				s = u.think.Write(s)
+			}
+			if s != "" && !emit(reasoning, s) {
+				return true, nil, nil
+			}
+		}
+		if data.Done || data.Phase == "done" {
+			return true, nil, nil
+		}
+	}
+}